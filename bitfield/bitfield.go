@@ -20,3 +20,17 @@ func (bf Bitfield) SetPiece(index int) {
 	}
 	bf[byteIndex] |= 1 << (7 - offset)
 }
+
+func New(pieces int) Bitfield {
+	return make(Bitfield, (pieces+7)/8)
+}
+
+func (bf Bitfield) Count() int {
+	count := 0
+	for _, b := range bf {
+		for ; b != 0; b &= b - 1 {
+			count++
+		}
+	}
+	return count
+}
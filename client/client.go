@@ -1,25 +1,75 @@
 package client
 
 import (
+	"bufio"
 	"bytes"
+	"errors"
 	"fmt"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 	"torry/bitfield"
 	"torry/handshake"
 	"torry/message"
 	"torry/peers"
+	"torry/ratelimit"
 )
 
 type Client struct {
 	Conn     net.Conn
+	reader   *bufio.Reader
 	Peer     peers.Peer
 	Bitfield bitfield.Bitfield
 	Choked   bool
 	InfoHash [20]byte
 	PeerID   [20]byte
+	Reserved handshake.Reserved
+	Inbound  bool
+
+	// note: a message read while waiting for a bitfield that never came, Read hands it out first
+	pending *message.Message
+
+	/*
+		note: the other direction, whether we choke the peer and whether it
+		wants our pieces. the choker flips these from its own goroutine
+	*/
+	AmChoking  atomic.Bool
+	Interested atomic.Bool
+
+	/*
+		note: what the peer told us in its extended handshake, name -> message
+		id. ListenPort is the "p" key, the port an inbound peer accepts
+		connections on. guarded by extMu, a late handshake can change them
+	*/
+	extMu        sync.Mutex
+	Extensions   map[string]int
+	MetadataSize int
+	ListenPort   int
+
+	// note: messages can be sent from more than one goroutine (uploads, choking)
+	writeMu sync.Mutex
+
+	download transferStats
+	upload   transferStats
+
+	// note: what reads from the connection have to get through, see SetDownloadLimits
+	limitsMu       sync.Mutex
+	downloadLimits []*ratelimit.Limiter
+
+	requestsMu   sync.Mutex
+	requestsCond *sync.Cond
+	requests     []BlockRequest
+	closed       bool
+	done         chan struct{}
 }
 
+/*
+note: sent as "p" in our extended handshake so peers that connected to us
+can tell others where to reach us, 0 leaves it out
+*/
+var AdvertisedPort int
+
 func completeHandshake(conn net.Conn, infohash, peerID [20]byte) (*handshake.Handshake, error) {
 	conn.SetDeadline(time.Now().Add(3 * time.Second))
 	defer conn.SetDeadline(time.Time{}) // Disable the deadline
@@ -39,91 +89,361 @@ func completeHandshake(conn net.Conn, infohash, peerID [20]byte) (*handshake.Han
 	}
 	return res, nil
 }
-func receiveBitfield(conn net.Conn) (bitfield.Bitfield, error) {
-	conn.SetDeadline(time.Now().Add(time.Second * 5))
-	defer conn.SetDeadline(time.Time{})
 
-	msg, err := message.Read(conn)
+/*
+note: the peer's extended handshake can arrive before or after its
+bitfield, so it is recorded on the way. a peer with no pieces doesn't have
+to send a bitfield at all: if it sends something else first, or nothing
+for a while, the bitfield stays empty and whatever came is kept for the
+next Read
+*/
+func (client *Client) receiveBitfield() error {
+	deadline := time.Now().Add(time.Second * 5)
+
+	for {
+		ready, err := client.Poll(time.Until(deadline))
+		if err != nil {
+			return err
+		}
+		if !ready {
+			return nil
+		}
+
+		client.Conn.SetReadDeadline(deadline)
+		msg, err := client.Read()
+		client.Conn.SetReadDeadline(time.Time{})
+		if err != nil {
+			return err
+		}
+
+		if msg == nil {
+			continue
+		}
+
+		switch msg.ID {
+		case message.MsgBitfield:
+			client.Bitfield = msg.Payload
+			return nil
+		case message.MsgExtended:
+			err = client.HandleExtended(msg)
+			if err != nil {
+				return err
+			}
+		default:
+			client.pending = msg
+			return nil
+		}
+	}
+}
+
+// note: connects and completes the bittorrent handshake, nothing else is sent yet
+func Dial(peer peers.Peer, infohash [20]byte, peerID [20]byte) (*Client, error) {
+	conn, err := net.DialTimeout("tcp", peer.Stringify(), time.Second*15)
+
 	if err != nil {
 		return nil, err
 	}
 
-	if msg.ID != message.MsgBitfield {
-		return nil, fmt.Errorf("expected messageID: %d but goe messageID: %d", message.MsgBitfield, msg.ID)
+	res, err := completeHandshake(conn, infohash, peerID)
+
+	if err != nil {
+		conn.Close()
+		return nil, err
 	}
 
-	return msg.Payload, nil
+	return newClient(conn, peer, res, infohash, peerID), nil
 }
 
-func New(peer peers.Peer, infohash [20]byte, peerID [20]byte) (*Client, error) {
-	conn, err := net.DialTimeout("tcp", peer.Stringify(), time.Second*15)
+func newClient(conn net.Conn, peer peers.Peer, res *handshake.Handshake, infohash, peerID [20]byte) *Client {
+	client := Client{
+		Conn:       conn,
+		Peer:       peer,
+		Choked:     true,
+		InfoHash:   infohash,
+		PeerID:     peerID,
+		Reserved:   res.Reserved,
+		Extensions: map[string]int{},
+		done:       make(chan struct{}),
+	}
+	client.reader = bufio.NewReader(limitedReader{&client})
+	client.AmChoking.Store(true)
+	client.requestsCond = sync.NewCond(&client.requestsMu)
+
+	return &client
+}
+
+/*
+note: the bitfield has to be the first message after the handshake, the
+extended handshake follows it. a bitfield with no pieces set is skipped
+*/
+func (client *Client) greet(have bitfield.Bitfield) error {
+	if have.Count() > 0 {
+		err := client.SendBitfield(have)
+		if err != nil {
+			return err
+		}
+	}
+
+	if client.Reserved.SupportsExtensions() {
+		return client.SendExtendedHandshake()
+	}
+
+	return nil
+}
+
+func New(peer peers.Peer, infohash [20]byte, peerID [20]byte, have bitfield.Bitfield) (*Client, error) {
+	client, err := Dial(peer, infohash, peerID)
 
 	if err != nil {
 		return nil, err
 	}
 
-	_, err = completeHandshake(conn, infohash, peerID)
+	err = client.greet(have)
 
 	if err != nil {
-		conn.Close()
+		client.Conn.Close()
 		return nil, err
 	}
 
-	bitfield, err := receiveBitfield(conn)
+	err = client.receiveBitfield()
 
 	if err != nil {
-		conn.Close()
+		client.Conn.Close()
 		return nil, err
 	}
 
-	client := Client{
-		Conn:     conn,
-		Peer:     peer,
-		Bitfield: bitfield,
-		Choked:   true,
-		InfoHash: infohash,
-		PeerID:   peerID,
+	return client, nil
+}
+
+/*
+note: for connections the peer opened. its handshake has already been read
+(that's how we knew which torrent it was for) so we answer with ours. a
+peer that has nothing yet doesn't have to send a bitfield so we don't wait
+for one
+*/
+func Accept(conn net.Conn, res *handshake.Handshake, peerID [20]byte, have bitfield.Bitfield) (*Client, error) {
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+	defer conn.SetDeadline(time.Time{})
+
+	req := handshake.New(res.InfoHash, peerID)
+	_, err := conn.Write(req.Serialize())
+	if err != nil {
+		return nil, err
+	}
+
+	addr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return nil, fmt.Errorf("unexpected remote address %s", conn.RemoteAddr())
+	}
+
+	peer := peers.Peer{IP: addr.IP, Port: uint16(addr.Port)}
+	client := newClient(conn, peer, res, res.InfoHash, peerID)
+	client.Inbound = true
+
+	err = client.greet(have)
+	if err != nil {
+		return nil, err
 	}
 
-	return &client, nil
+	return client, nil
 }
 
-func (client Client) Read() (*message.Message, error) {
-	msg, err := message.Read(client.Conn)
+func (client *Client) SupportsExtension(name string) bool {
+	client.extMu.Lock()
+	defer client.extMu.Unlock()
+
+	_, ok := client.Extensions[name]
+	return ok
+}
+
+/*
+note: only the extended handshake is handled here, every other extended
+message is left to whoever owns the extension
+*/
+func (client *Client) HandleExtended(msg *message.Message) error {
+	extID, _, err := message.ParseExtended(msg)
+	if err != nil {
+		return err
+	}
+
+	if extID != message.ExtHandshake {
+		return nil
+	}
+
+	eh, err := message.ParseExtendedHandshake(msg)
+	if err != nil {
+		return err
+	}
+
+	client.extMu.Lock()
+	defer client.extMu.Unlock()
+
+	// note: an id of 0 means the peer turned the extension off
+	for name, id := range eh.M {
+		if id == 0 {
+			delete(client.Extensions, name)
+		} else {
+			client.Extensions[name] = id
+		}
+	}
+
+	if eh.MetadataSize > 0 {
+		client.MetadataSize = eh.MetadataSize
+	}
+
+	if eh.Port > 0 && eh.Port <= 65535 {
+		client.ListenPort = eh.Port
+	}
+
+	return nil
+}
+
+/*
+note: every read from the connection is paid for with tokens from the
+limiters after the fact, a peer that is over the limit simply isn't read
+from until it's paid off and tcp slows the sender down for us
+*/
+type limitedReader struct {
+	client *Client
+}
+
+func (lr limitedReader) Read(p []byte) (int, error) {
+	n, err := lr.client.Conn.Read(p)
+	if n > 0 {
+		lr.client.limitsMu.Lock()
+		limiters := lr.client.downloadLimits
+		lr.client.limitsMu.Unlock()
+
+		ratelimit.Wait(lr.client.done, n, limiters...)
+	}
+	return n, err
+}
+
+func (client *Client) SetDownloadLimits(limiters ...*ratelimit.Limiter) {
+	client.limitsMu.Lock()
+	defer client.limitsMu.Unlock()
+
+	client.downloadLimits = limiters
+}
+
+func (client *Client) Read() (*message.Message, error) {
+	if client.pending != nil {
+		msg := client.pending
+		client.pending = nil
+		return msg, nil
+	}
+
+	msg, err := message.Read(client.reader)
 	return msg, err
 }
 
-func (client Client) SendRequest(index, begin, length int) error {
-	msg := message.FormatRequestMsg(index, begin, length)
+/*
+note: waits up to timeout for the next message to start arriving without
+consuming any of it, so giving up never leaves half a message behind
+*/
+func (client *Client) Poll(timeout time.Duration) (bool, error) {
+	client.Conn.SetReadDeadline(time.Now().Add(timeout))
+	defer client.Conn.SetReadDeadline(time.Time{})
 
-	_, err := client.Conn.Write(msg.Serialize())
-	return err
+	_, err := client.reader.Peek(1)
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+/*
+note: where the peer accepts connections. that's the address we dialed, for
+an inbound peer it's only known if its extended handshake had a port
+*/
+func (client *Client) ListenAddr() (peers.Peer, bool) {
+	if !client.Inbound {
+		return client.Peer, true
+	}
+
+	client.extMu.Lock()
+	defer client.extMu.Unlock()
+
+	if client.ListenPort == 0 {
+		return peers.Peer{}, false
+	}
+
+	return peers.Peer{IP: client.Peer.IP, Port: uint16(client.ListenPort)}, true
 }
 
-func (client Client) SendInterested() error {
-	msg := message.Message{ID: message.MsgInterested}
+func (client *Client) send(msg *message.Message) error {
+	client.writeMu.Lock()
+	defer client.writeMu.Unlock()
 
 	_, err := client.Conn.Write(msg.Serialize())
 	return err
 }
 
-func (client Client) SendNotInterested() error {
-	msg := message.Message{ID: message.MsgNotInterested}
+func (client *Client) SendExtendedHandshake() error {
+	msg, err := message.FormatExtendedHandshakeMsg(&message.ExtendedHandshake{
+		M:       message.LocalExtensions,
+		Version: "torry",
+		Port:    AdvertisedPort,
+		Reqq:    MAX_QUEUED_REQUESTS,
+	})
+	if err != nil {
+		return err
+	}
 
-	_, err := client.Conn.Write(msg.Serialize())
-	return err
+	return client.send(msg)
 }
 
-func (client Client) SendUnchoke() error {
-	msg := message.Message{ID: message.MsgUnchoke}
+func (client *Client) SendExtended(name string, payload []byte) error {
+	client.extMu.Lock()
+	extID, ok := client.Extensions[name]
+	client.extMu.Unlock()
+	if !ok {
+		return fmt.Errorf("peer does not support %s", name)
+	}
 
-	_, err := client.Conn.Write(msg.Serialize())
-	return err
+	return client.send(message.FormatExtendedMsg(extID, payload))
 }
 
-func (client Client) SendHave(index int) error {
-	msg := message.FormatHaveMsg(index)
+func (client *Client) SendBitfield(bf bitfield.Bitfield) error {
+	return client.send(message.FormatBitfieldMsg(bf))
+}
 
-	_, err := client.Conn.Write(msg.Serialize())
-	return err
+func (client *Client) SendRequest(index, begin, length int) error {
+	return client.send(message.FormatRequestMsg(index, begin, length))
+}
+
+func (client *Client) SendCancel(index, begin, length int) error {
+	return client.send(message.FormatCancelMsg(index, begin, length))
+}
+
+func (client *Client) SendPiece(index, begin int, block []byte) error {
+	return client.send(message.FormatPieceMsg(index, begin, block))
+}
+
+func (client *Client) SendInterested() error {
+	return client.send(&message.Message{ID: message.MsgInterested})
+}
+
+func (client *Client) SendNotInterested() error {
+	return client.send(&message.Message{ID: message.MsgNotInterested})
+}
+
+func (client *Client) SendChoke() error {
+	client.AmChoking.Store(true)
+	return client.send(&message.Message{ID: message.MsgChoke})
+}
+
+func (client *Client) SendUnchoke() error {
+	client.AmChoking.Store(false)
+	return client.send(&message.Message{ID: message.MsgUnchoke})
+}
+
+func (client *Client) SendHave(index int) error {
+	return client.send(message.FormatHaveMsg(index))
 }
@@ -0,0 +1,86 @@
+package client
+
+import (
+	"sync"
+	"time"
+)
+
+/*
+NOTES
+- Bytes are counted as they go over the wire, the rate is only worked out
+  when someone samples it (the choker does, every round) and is the average
+  since the previous sample
+*/
+
+type transferStats struct {
+	mu          sync.Mutex
+	total       int64
+	sampleTotal int64
+	sampleTime  time.Time
+	rate        float64
+}
+
+func (s *transferStats) add(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.total += int64(n)
+}
+
+func (s *transferStats) sample(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.sampleTime.IsZero() {
+		elapsed := now.Sub(s.sampleTime).Seconds()
+		if elapsed > 0 {
+			s.rate = float64(s.total-s.sampleTotal) / elapsed
+		}
+	}
+
+	s.sampleTotal = s.total
+	s.sampleTime = now
+}
+
+func (s *transferStats) get() (int64, float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.total, s.rate
+}
+
+func (client *Client) RecordDownload(n int) {
+	client.download.add(n)
+}
+
+func (client *Client) RecordUpload(n int) {
+	client.upload.add(n)
+}
+
+func (client *Client) SampleRates() {
+	now := time.Now()
+	client.download.sample(now)
+	client.upload.sample(now)
+}
+
+// note: bytes per second from this peer as of the last sample
+func (client *Client) DownloadRate() float64 {
+	_, rate := client.download.get()
+	return rate
+}
+
+// note: bytes per second to this peer as of the last sample
+func (client *Client) UploadRate() float64 {
+	_, rate := client.upload.get()
+	return rate
+}
+
+func (client *Client) Downloaded() int64 {
+	total, _ := client.download.get()
+	return total
+}
+
+func (client *Client) Uploaded() int64 {
+	total, _ := client.upload.get()
+	return total
+}
@@ -0,0 +1,86 @@
+package client
+
+/*
+NOTES
+- Requests the peer sent us wait here until the upload side gets to them,
+  which gives a cancel the chance to take one back before it's served
+- At most MAX_QUEUED_REQUESTS wait at a time, the number is sent as "reqq"
+  in our extended handshake. Requests past it are dropped, the peer asked
+  for more than we said we'd hold
+*/
+
+const MAX_QUEUED_REQUESTS = 250
+
+type BlockRequest struct {
+	Index  int
+	Begin  int
+	Length int
+}
+
+func (client *Client) QueueRequest(req BlockRequest) {
+	client.requestsMu.Lock()
+	defer client.requestsMu.Unlock()
+
+	if client.closed || len(client.requests) >= MAX_QUEUED_REQUESTS {
+		return
+	}
+
+	client.requests = append(client.requests, req)
+	client.requestsCond.Signal()
+}
+
+func (client *Client) CancelRequest(req BlockRequest) {
+	client.requestsMu.Lock()
+	defer client.requestsMu.Unlock()
+
+	for i, r := range client.requests {
+		if r == req {
+			client.requests = append(client.requests[:i], client.requests[i+1:]...)
+			return
+		}
+	}
+}
+
+// note: a choked peer loses whatever it had queued up
+func (client *Client) ClearRequests() {
+	client.requestsMu.Lock()
+	defer client.requestsMu.Unlock()
+
+	client.requests = nil
+}
+
+// note: blocks until there is a request to serve, returns false once the client is closed
+func (client *Client) NextRequest() (BlockRequest, bool) {
+	client.requestsMu.Lock()
+	defer client.requestsMu.Unlock()
+
+	for len(client.requests) == 0 && !client.closed {
+		client.requestsCond.Wait()
+	}
+
+	if client.closed {
+		return BlockRequest{}, false
+	}
+
+	req := client.requests[0]
+	client.requests = client.requests[1:]
+	return req, true
+}
+
+// note: closed once the client is, for goroutines that work alongside the connection
+func (client *Client) Done() <-chan struct{} {
+	return client.done
+}
+
+func (client *Client) Close() error {
+	client.requestsMu.Lock()
+	if !client.closed {
+		close(client.done)
+	}
+	client.closed = true
+	client.requests = nil
+	client.requestsCond.Broadcast()
+	client.requestsMu.Unlock()
+
+	return client.Conn.Close()
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"torry/torrentfile"
+)
+
+// note: a flag that can be given more than once
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, " ")
+}
+
+func (l *listFlag) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+/*
+note: torry create [flags] <path>, every -announce is a tier of its own,
+trackers of the same tier are separated by commas. the torrent is opened
+again after writing it so the infohash printed is the one clients will see
+*/
+func runCreate(args []string) {
+	fs := flag.NewFlagSet("create", flag.ExitOnError)
+	out := fs.String("o", "", "where to write the torrent, <name>.torrent if empty")
+	pieceLength := fs.Int("piece-length", 0, "piece length in KiB, picked from the size if 0")
+	comment := fs.String("comment", "", "comment")
+	createdBy := fs.String("created-by", "torry", "created by")
+	private := fs.Bool("private", false, "only use the trackers to find peers (BEP 27)")
+	var announce, webSeeds listFlag
+	fs.Var(&announce, "announce", "tracker URL, repeat for more tiers, comma separate trackers of one tier")
+	fs.Var(&webSeeds, "webseed", "web seed URL, can be repeated")
+	fs.Usage = func() {
+		fmt.Println("Use: torry create [flags] path/to/file/or/dir")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	root := fs.Arg(0)
+
+	tiers := [][]string{}
+	for _, tier := range announce {
+		urls := []string{}
+		for _, u := range strings.Split(tier, ",") {
+			if u = strings.TrimSpace(u); u != "" {
+				urls = append(urls, u)
+			}
+		}
+		tiers = append(tiers, urls)
+	}
+
+	data, err := torrentfile.Create(root, torrentfile.CreateOptions{
+		PieceLength:  *pieceLength * 1024,
+		AnnounceList: tiers,
+		Comment:      *comment,
+		CreatedBy:    *createdBy,
+		Private:      *private,
+		WebSeeds:     webSeeds,
+	})
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	if *out == "" {
+		abs, err := filepath.Abs(root)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		*out = filepath.Base(abs) + ".torrent"
+	}
+
+	err = os.WriteFile(*out, data, 0644)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	tf, err := torrentfile.OpenTorrentFile(*out)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Wrote %s\n", *out)
+	fmt.Printf("  infohash: %x\n", tf.InfoHash)
+	fmt.Printf("  %d files, %d bytes, %d pieces of %d bytes\n", len(tf.Files), tf.Length, len(tf.PieceHashes), tf.PieceLength)
+}
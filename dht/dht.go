@@ -0,0 +1,478 @@
+package dht
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+	"torry/peers"
+)
+
+/*
+NOTES
+- A mainline DHT node (BEP 5). It answers ping, find_node, get_peers and
+  announce_peer from other nodes and runs iterative lookups of its own to
+  find peers for an infohash
+- get_peers answers carry a token, it has to be handed back in the
+  announce_peer to the same node. Our tokens are sha1(ip + secret), the
+  secret rotates every few minutes and the previous one is still accepted
+- Peers other nodes announce to us are kept for a while and handed out in
+  get_peers responses
+*/
+
+const QUERY_TIMEOUT = 2 * time.Second
+const ALPHA = 3
+const MAX_LOOKUP_ROUNDS = 16
+const SECRET_ROTATE_INTERVAL = 5 * time.Minute
+const REFRESH_INTERVAL = 15 * time.Minute
+const PEER_EXPIRY = 30 * time.Minute
+const MAX_STORED_PEERS = 100
+
+var DefaultBootstrapNodes = []string{
+	"router.bittorrent.com:6881",
+	"dht.transmissionbt.com:6881",
+	"router.utorrent.com:6881",
+}
+
+type storedPeer struct {
+	peer    peers.Peer
+	expires time.Time
+}
+
+// note: a query waiting for its response, only the node it went to may answer it
+type pendingQuery struct {
+	addr *net.UDPAddr
+	ch   chan krpcMsg
+}
+
+type DHT struct {
+	ID [20]byte
+
+	conn  *net.UDPConn
+	table *routingTable
+	path  string
+
+	mu         sync.Mutex
+	pending    map[string]pendingQuery
+	secret     [20]byte
+	prevSecret [20]byte
+	store      map[[20]byte]map[string]storedPeer
+	closed     chan struct{}
+}
+
+/*
+note: opens the node on the given UDP port (0 picks one). if a routing
+table was saved at path the node keeps its old id and starts from the saved
+nodes, an empty path means no persistence
+*/
+func New(port int, path string) (*DHT, error) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{Port: port})
+	if err != nil {
+		return nil, err
+	}
+
+	d := DHT{
+		conn:    conn,
+		path:    path,
+		pending: map[string]pendingQuery{},
+		store:   map[[20]byte]map[string]storedPeer{},
+		closed:  make(chan struct{}),
+	}
+
+	saved, err := loadTable(path)
+	if err == nil {
+		d.ID = saved.id
+	} else {
+		_, err = rand.Read(d.ID[:])
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	d.table = newRoutingTable(d.ID)
+	if saved != nil {
+		for _, n := range saved.nodes {
+			d.table.insert(n.id, n.addr)
+		}
+	}
+
+	rand.Read(d.secret[:])
+	d.prevSecret = d.secret
+
+	go d.readLoop()
+	go d.maintain()
+
+	return &d, nil
+}
+
+func (d *DHT) Port() int {
+	return d.conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+func (d *DHT) Close() error {
+	select {
+	case <-d.closed:
+		return nil
+	default:
+		close(d.closed)
+	}
+
+	err := d.Save()
+	d.conn.Close()
+	return err
+}
+
+func (d *DHT) isClosed() bool {
+	select {
+	case <-d.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+/*
+note: fills the routing table. the given nodes (host:port, e.g. the
+torrent's nodes key) and the default routers are asked for the nodes
+closest to us, then we look ourselves up to meet our neighbourhood
+*/
+func (d *DHT) Bootstrap(nodes []string) error {
+	addrs := []*net.UDPAddr{}
+	for _, hostport := range append(append([]string{}, nodes...), DefaultBootstrapNodes...) {
+		addr, err := net.ResolveUDPAddr("udp4", hostport)
+		if err != nil {
+			continue
+		}
+		addrs = append(addrs, addr)
+	}
+
+	var wg sync.WaitGroup
+	for _, addr := range addrs {
+		wg.Add(1)
+		go func(addr *net.UDPAddr) {
+			defer wg.Done()
+			d.findNode(addr, d.ID)
+		}(addr)
+	}
+	wg.Wait()
+
+	d.lookup(d.ID, "find_node")
+
+	if d.table.size() == 0 {
+		return errors.New("could not reach any DHT node")
+	}
+
+	return nil
+}
+
+// note: an iterative get_peers lookup for the infohash
+func (d *DHT) GetPeers(infoHash [20]byte) ([]peers.Peer, error) {
+	res := d.lookup(infoHash, "get_peers")
+
+	if len(res.peers) == 0 {
+		return nil, fmt.Errorf("no peers found in the DHT for %x", infoHash)
+	}
+
+	return res.peers, nil
+}
+
+/*
+note: looks up the infohash and tells the closest nodes that we are a
+peer for it on the given port. returns the peers found along the way
+*/
+func (d *DHT) Announce(infoHash [20]byte, port int) ([]peers.Peer, error) {
+	res := d.lookup(infoHash, "get_peers")
+
+	announced := 0
+	for _, n := range res.closest {
+		if n.token == "" {
+			continue
+		}
+
+		_, err := d.query(n.addr, "announce_peer", map[string]interface{}{
+			"info_hash":    string(infoHash[:]),
+			"port":         port,
+			"token":        n.token,
+			"implied_port": 0,
+		})
+		if err == nil {
+			announced++
+		}
+	}
+
+	if announced == 0 && len(res.peers) == 0 {
+		return nil, fmt.Errorf("could not announce %x to the DHT", infoHash)
+	}
+
+	return res.peers, nil
+}
+
+func (d *DHT) readLoop() {
+	buf := make([]byte, 65536)
+
+	for {
+		n, addr, err := d.conn.ReadFromUDP(buf)
+		if err != nil {
+			if d.isClosed() {
+				return
+			}
+			continue
+		}
+
+		msg, err := decodeMsg(buf[:n])
+		if err != nil {
+			continue
+		}
+
+		d.handleMsg(msg, addr)
+	}
+}
+
+func (d *DHT) handleMsg(msg krpcMsg, addr *net.UDPAddr) {
+	tid, ok := msg.str("t")
+	if !ok {
+		return
+	}
+
+	y, _ := msg.str("y")
+	switch y {
+	case "q":
+		d.handleQuery(tid, msg, addr)
+	case "r", "e":
+		d.mu.Lock()
+		q, ok := d.pending[tid]
+		if ok && q.addr.IP.Equal(addr.IP) && q.addr.Port == addr.Port {
+			delete(d.pending, tid)
+		} else {
+			ok = false
+		}
+		d.mu.Unlock()
+
+		if ok {
+			q.ch <- msg
+		}
+	}
+}
+
+func (d *DHT) send(addr *net.UDPAddr, msg krpcMsg) error {
+	packet, err := encodeMsg(msg)
+	if err != nil {
+		return err
+	}
+
+	_, err = d.conn.WriteToUDP(packet, addr)
+	return err
+}
+
+/*
+note: registers the query under a random transaction id nobody else is
+waiting on. sequential ids are easy to guess, which would let anyone answer
+queries they never saw
+*/
+func (d *DHT) addPending(q pendingQuery) (string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for {
+		var b [4]byte
+		_, err := rand.Read(b[:])
+		if err != nil {
+			return "", err
+		}
+
+		tid := string(b[:])
+		if _, taken := d.pending[tid]; !taken {
+			d.pending[tid] = q
+			return tid, nil
+		}
+	}
+}
+
+// note: sends a query and waits for its response, the responder lands in the routing table
+func (d *DHT) query(addr *net.UDPAddr, method string, args map[string]interface{}) (krpcMsg, error) {
+	ch := make(chan krpcMsg, 1)
+	tid, err := d.addPending(pendingQuery{addr: addr, ch: ch})
+	if err != nil {
+		return nil, err
+	}
+
+	args["id"] = string(d.ID[:])
+	err = d.send(addr, krpcMsg{"t": tid, "y": "q", "q": method, "a": args})
+	if err != nil {
+		d.mu.Lock()
+		delete(d.pending, tid)
+		d.mu.Unlock()
+		return nil, err
+	}
+
+	select {
+	case msg := <-ch:
+		if y, _ := msg.str("y"); y == "e" {
+			return nil, parseError(msg)
+		}
+
+		r, ok := msg.dict("r")
+		if !ok {
+			return nil, errors.New("krpc response without a body")
+		}
+
+		id, ok := r.nodeID()
+		if !ok {
+			return nil, errors.New("krpc response without a node id")
+		}
+		d.addNode(id, addr)
+
+		return r, nil
+	case <-time.After(QUERY_TIMEOUT):
+		d.mu.Lock()
+		delete(d.pending, tid)
+		d.mu.Unlock()
+		return nil, fmt.Errorf("%s query to %s timed out", method, addr)
+	case <-d.closed:
+		return nil, errors.New("dht node closed")
+	}
+}
+
+func parseError(msg krpcMsg) error {
+	e, ok := msg.list("e")
+	if !ok || len(e) < 2 {
+		return &krpcError{Code: errGeneric, Message: "malformed error"}
+	}
+
+	code, _ := e[0].(int64)
+	text, _ := e[1].(string)
+	return &krpcError{Code: code, Message: text}
+}
+
+/*
+note: a node we heard from goes into the table. when its bucket is full
+the least recently seen node gets pinged and is only replaced if it
+doesn't answer
+*/
+func (d *DHT) addNode(id [20]byte, addr *net.UDPAddr) {
+	oldest := d.table.insert(id, addr)
+	if oldest == nil {
+		return
+	}
+
+	go func() {
+		_, err := d.query(oldest.addr, "ping", map[string]interface{}{})
+		if err != nil {
+			d.table.replace(oldest, id, addr)
+		}
+	}()
+}
+
+func (d *DHT) findNode(addr *net.UDPAddr, target [20]byte) ([]*node, error) {
+	r, err := d.query(addr, "find_node", map[string]interface{}{"target": string(target[:])})
+	if err != nil {
+		return nil, err
+	}
+
+	compact, _ := r.str("nodes")
+	return decodeNodes(compact)
+}
+
+func (d *DHT) maintain() {
+	rotate := time.NewTicker(SECRET_ROTATE_INTERVAL)
+	defer rotate.Stop()
+	refresh := time.NewTicker(REFRESH_INTERVAL)
+	defer refresh.Stop()
+
+	for {
+		select {
+		case <-d.closed:
+			return
+		case <-rotate.C:
+			d.mu.Lock()
+			d.prevSecret = d.secret
+			rand.Read(d.secret[:])
+			for infoHash, swarm := range d.store {
+				for addr, sp := range swarm {
+					if time.Now().After(sp.expires) {
+						delete(swarm, addr)
+					}
+				}
+				if len(swarm) == 0 {
+					delete(d.store, infoHash)
+				}
+			}
+			d.mu.Unlock()
+		case <-refresh.C:
+			// note: a random id sharing the bucket's prefix with ours lands in that bucket
+			for _, b := range d.table.staleBuckets() {
+				target := randomIDInBucket(d.ID, b)
+				d.lookup(target, "find_node")
+			}
+			d.Save()
+		}
+	}
+}
+
+func randomIDInBucket(self [20]byte, bucket int) [20]byte {
+	var id [20]byte
+	rand.Read(id[:])
+
+	if bucket >= 160 {
+		return self
+	}
+
+	for bit := 0; bit < bucket; bit++ {
+		mask := byte(0x80 >> (bit % 8))
+		id[bit/8] = id[bit/8]&^mask | self[bit/8]&mask
+	}
+
+	// note: the first differing bit decides the bucket
+	mask := byte(0x80 >> (bucket % 8))
+	id[bucket/8] = id[bucket/8]&^mask | ^self[bucket/8]&mask
+
+	return id
+}
+
+func (d *DHT) token(ip net.IP, secret [20]byte) string {
+	hash := sha1.Sum(append(append([]byte{}, ip.To16()...), secret[:]...))
+	return string(hash[:])
+}
+
+func (d *DHT) validToken(ip net.IP, token string) bool {
+	d.mu.Lock()
+	secret, prev := d.secret, d.prevSecret
+	d.mu.Unlock()
+
+	return token == d.token(ip, secret) || token == d.token(ip, prev)
+}
+
+func (d *DHT) storedPeers(infoHash [20]byte) []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	values := []string{}
+	for _, sp := range d.store[infoHash] {
+		if time.Now().Before(sp.expires) {
+			values = append(values, encodePeer(sp.peer))
+		}
+	}
+	return values
+}
+
+func (d *DHT) storePeer(infoHash [20]byte, peer peers.Peer) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	swarm, ok := d.store[infoHash]
+	if !ok {
+		swarm = map[string]storedPeer{}
+		d.store[infoHash] = swarm
+	}
+
+	addr := peer.Stringify()
+	if _, ok := swarm[addr]; !ok && len(swarm) >= MAX_STORED_PEERS {
+		return
+	}
+
+	swarm[addr] = storedPeer{peer: peer, expires: time.Now().Add(PEER_EXPIRY)}
+}
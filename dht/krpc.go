@@ -0,0 +1,181 @@
+package dht
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"torry/peers"
+	"torry/rawbencode"
+
+	bencode "github.com/jackpal/bencode-go"
+)
+
+/*
+NOTES
+- KRPC is bencoded dictionaries over UDP. Every message has a transaction
+  id "t" and a type "y": "q" for a query, "r" for a response and "e" for
+  an error
+- Queries name a method in "q" and carry their arguments in "a", the
+  querying node's id is always in there. Responses carry "r" with the
+  responding node's id
+- Nodes are passed around in compact form: 20 byte id, 4 byte IPv4
+  address and 2 byte port. Peers use the 6 byte compact form trackers use
+*/
+
+const compactNodeSize = 26
+
+type krpcMsg map[string]interface{}
+
+type krpcError struct {
+	Code    int64
+	Message string
+}
+
+func (e *krpcError) Error() string {
+	return fmt.Sprintf("krpc error %d: %s", e.Code, e.Message)
+}
+
+const (
+	errGeneric  = 201
+	errProtocol = 203
+	errMethod   = 204
+)
+
+func encodeMsg(msg krpcMsg) ([]byte, error) {
+	var buff bytes.Buffer
+
+	err := bencode.Marshal(&buff, map[string]interface{}(msg))
+	if err != nil {
+		return nil, err
+	}
+
+	return buff.Bytes(), nil
+}
+
+// note: packets come from anyone, they are checked before the decoder gets to see them
+func decodeMsg(packet []byte) (krpcMsg, error) {
+	err := rawbencode.Check(packet)
+	if err != nil {
+		return nil, err
+	}
+
+	v, err := bencode.Decode(bytes.NewReader(packet))
+	if err != nil {
+		return nil, err
+	}
+
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("krpc message is not a dict")
+	}
+
+	return krpcMsg(m), nil
+}
+
+func (m krpcMsg) str(key string) (string, bool) {
+	s, ok := m[key].(string)
+	return s, ok
+}
+
+func (m krpcMsg) int(key string) (int64, bool) {
+	i, ok := m[key].(int64)
+	return i, ok
+}
+
+func (m krpcMsg) dict(key string) (krpcMsg, bool) {
+	d, ok := m[key].(map[string]interface{})
+	return krpcMsg(d), ok
+}
+
+func (m krpcMsg) list(key string) ([]interface{}, bool) {
+	l, ok := m[key].([]interface{})
+	return l, ok
+}
+
+// note: pulls the 20 byte id out of a query's "a" or a response's "r"
+func (m krpcMsg) nodeID() ([20]byte, bool) {
+	var id [20]byte
+
+	s, ok := m.str("id")
+	if !ok || len(s) != 20 {
+		return id, false
+	}
+
+	copy(id[:], s)
+	return id, true
+}
+
+func encodeNodes(nodes []*node) string {
+	buf := make([]byte, 0, len(nodes)*compactNodeSize)
+
+	for _, n := range nodes {
+		ip := n.addr.IP.To4()
+		if ip == nil {
+			continue
+		}
+
+		buf = append(buf, n.id[:]...)
+		buf = append(buf, ip...)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(n.addr.Port))
+	}
+
+	return string(buf)
+}
+
+func decodeNodes(compact string) ([]*node, error) {
+	if len(compact)%compactNodeSize != 0 {
+		return nil, fmt.Errorf("received malformed nodes of length [%d]", len(compact))
+	}
+
+	nodes := make([]*node, 0, len(compact)/compactNodeSize)
+
+	for offset := 0; offset < len(compact); offset += compactNodeSize {
+		n := node{}
+		copy(n.id[:], compact[offset:offset+20])
+
+		ip := make(net.IP, 4)
+		copy(ip, compact[offset+20:offset+24])
+		port := binary.BigEndian.Uint16([]byte(compact[offset+24 : offset+26]))
+		if port == 0 {
+			continue
+		}
+
+		n.addr = &net.UDPAddr{IP: ip, Port: int(port)}
+		nodes = append(nodes, &n)
+	}
+
+	return nodes, nil
+}
+
+func encodePeer(p peers.Peer) string {
+	ip := p.IP.To4()
+	if ip == nil {
+		return ""
+	}
+
+	buf := append([]byte{}, ip...)
+	buf = binary.BigEndian.AppendUint16(buf, p.Port)
+	return string(buf)
+}
+
+// note: "values" is a list of 6 byte compact peers, anything else in there is skipped
+func decodeValues(values []interface{}) []peers.Peer {
+	list := []peers.Peer{}
+
+	for _, v := range values {
+		s, ok := v.(string)
+		if !ok || len(s) != 6 {
+			continue
+		}
+
+		parsed, err := peers.UnmarshallPeers([]byte(s))
+		if err != nil {
+			continue
+		}
+		list = append(list, parsed...)
+	}
+
+	return list
+}
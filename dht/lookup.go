@@ -0,0 +1,120 @@
+package dht
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"torry/peers"
+)
+
+/*
+NOTES
+- Iterative lookup: keep the K closest nodes we know of for the target,
+  query up to ALPHA of the ones we haven't asked yet, fold the nodes they
+  return into the set and repeat until the K closest have all been asked
+- get_peers responses may also carry peers ("values") and a token we need
+  to announce to that node later
+*/
+
+type lookupNode struct {
+	id      [20]byte
+	addr    *net.UDPAddr
+	queried bool
+	replied bool
+	token   string
+}
+
+type lookupResult struct {
+	peers   []peers.Peer
+	closest []*lookupNode
+}
+
+func (d *DHT) lookup(target [20]byte, method string) *lookupResult {
+	var mu sync.Mutex
+	seen := map[string]*lookupNode{}
+	candidates := []*lookupNode{}
+	found := map[string]peers.Peer{}
+
+	add := func(id [20]byte, addr *net.UDPAddr) {
+		key := addr.String()
+		if _, ok := seen[key]; ok || id == d.ID {
+			return
+		}
+		ln := &lookupNode{id: id, addr: addr}
+		seen[key] = ln
+		candidates = append(candidates, ln)
+	}
+
+	for _, n := range d.table.closest(target, K) {
+		add(n.id, n.addr)
+	}
+
+	for round := 0; round < MAX_LOOKUP_ROUNDS; round++ {
+		mu.Lock()
+		sort.Slice(candidates, func(i, j int) bool {
+			return closer(target, candidates[i].id, candidates[j].id)
+		})
+
+		batch := []*lookupNode{}
+		for _, ln := range candidates[:min(K, len(candidates))] {
+			if !ln.queried && len(batch) < ALPHA {
+				ln.queried = true
+				batch = append(batch, ln)
+			}
+		}
+		mu.Unlock()
+
+		if len(batch) == 0 {
+			break
+		}
+
+		var wg sync.WaitGroup
+		for _, ln := range batch {
+			wg.Add(1)
+			go func(ln *lookupNode) {
+				defer wg.Done()
+
+				key := "target"
+				if method == "get_peers" {
+					key = "info_hash"
+				}
+
+				r, err := d.query(ln.addr, method, map[string]interface{}{key: string(target[:])})
+				if err != nil {
+					d.table.failed(ln.id)
+					return
+				}
+
+				compact, _ := r.str("nodes")
+				nodes, _ := decodeNodes(compact)
+				values, _ := r.list("values")
+				token, _ := r.str("token")
+
+				mu.Lock()
+				defer mu.Unlock()
+
+				ln.replied = true
+				ln.token = token
+				for _, n := range nodes {
+					add(n.id, n.addr)
+				}
+				for _, p := range decodeValues(values) {
+					found[p.Stringify()] = p
+				}
+			}(ln)
+		}
+		wg.Wait()
+	}
+
+	res := lookupResult{}
+	for _, p := range found {
+		res.peers = append(res.peers, p)
+	}
+	for _, ln := range candidates {
+		if ln.replied && len(res.closest) < K {
+			res.closest = append(res.closest, ln)
+		}
+	}
+
+	return &res
+}
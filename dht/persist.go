@@ -0,0 +1,91 @@
+package dht
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+
+	bencode "github.com/jackpal/bencode-go"
+)
+
+// note: the node id and the good nodes of the routing table, in compact form
+type savedTable struct {
+	ID    string `bencode:"id"`
+	Nodes string `bencode:"nodes"`
+}
+
+type loadedTable struct {
+	id    [20]byte
+	nodes []*node
+}
+
+func loadTable(path string) (*loadedTable, error) {
+	if path == "" {
+		return nil, errors.New("no routing table path")
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	st := savedTable{}
+	err = bencode.Unmarshal(file, &st)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(st.ID) != 20 {
+		return nil, errors.New("saved routing table has a malformed node id")
+	}
+
+	nodes, err := decodeNodes(st.Nodes)
+	if err != nil {
+		return nil, err
+	}
+
+	lt := loadedTable{nodes: nodes}
+	copy(lt.id[:], st.ID)
+	return &lt, nil
+}
+
+// note: written to a temporary file first so a crash never leaves half a table behind
+func (d *DHT) Save() error {
+	if d.path == "" {
+		return nil
+	}
+
+	var buff bytes.Buffer
+	err := bencode.Marshal(&buff, savedTable{
+		ID:    string(d.ID[:]),
+		Nodes: encodeNodes(d.table.closest(d.ID, d.table.size())),
+	})
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(d.path), 0755)
+	if err != nil {
+		return err
+	}
+
+	tmp := d.path + ".tmp"
+	err = os.WriteFile(tmp, buff.Bytes(), 0644)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, d.path)
+}
+
+// note: where the routing table is kept between runs, empty if there's no cache dir
+func DefaultTablePath() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+
+	return filepath.Join(dir, "torry", "dht.dat")
+}
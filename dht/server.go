@@ -0,0 +1,91 @@
+package dht
+
+import (
+	"net"
+	"torry/peers"
+)
+
+// note: answers queries from other nodes, anything we can't make sense of gets a protocol error
+func (d *DHT) handleQuery(tid string, msg krpcMsg, addr *net.UDPAddr) {
+	method, _ := msg.str("q")
+	args, ok := msg.dict("a")
+	if !ok {
+		d.sendError(tid, addr, errProtocol, "missing arguments")
+		return
+	}
+
+	id, ok := args.nodeID()
+	if !ok {
+		d.sendError(tid, addr, errProtocol, "missing node id")
+		return
+	}
+
+	r := map[string]interface{}{"id": string(d.ID[:])}
+
+	switch method {
+	case "ping":
+	case "find_node":
+		target, ok := args.str("target")
+		if !ok || len(target) != 20 {
+			d.sendError(tid, addr, errProtocol, "bad target")
+			return
+		}
+		r["nodes"] = encodeNodes(d.table.closest([20]byte([]byte(target)), K))
+	case "get_peers":
+		infoHash, ok := args.str("info_hash")
+		if !ok || len(infoHash) != 20 {
+			d.sendError(tid, addr, errProtocol, "bad info_hash")
+			return
+		}
+
+		d.mu.Lock()
+		secret := d.secret
+		d.mu.Unlock()
+		r["token"] = d.token(addr.IP, secret)
+
+		values := d.storedPeers([20]byte([]byte(infoHash)))
+		if len(values) > 0 {
+			list := make([]interface{}, len(values))
+			for i, v := range values {
+				list[i] = v
+			}
+			r["values"] = list
+		} else {
+			r["nodes"] = encodeNodes(d.table.closest([20]byte([]byte(infoHash)), K))
+		}
+	case "announce_peer":
+		infoHash, ok := args.str("info_hash")
+		if !ok || len(infoHash) != 20 {
+			d.sendError(tid, addr, errProtocol, "bad info_hash")
+			return
+		}
+
+		token, _ := args.str("token")
+		if !d.validToken(addr.IP, token) {
+			d.sendError(tid, addr, errProtocol, "bad token")
+			return
+		}
+
+		// note: with implied_port set the peer listens on the port it sent this from
+		port, _ := args.int("port")
+		if implied, _ := args.int("implied_port"); implied != 0 {
+			port = int64(addr.Port)
+		}
+		if port <= 0 || port > 65535 {
+			d.sendError(tid, addr, errProtocol, "bad port")
+			return
+		}
+
+		d.storePeer([20]byte([]byte(infoHash)), peers.Peer{IP: addr.IP, Port: uint16(port)})
+	default:
+		d.sendError(tid, addr, errMethod, "method unknown")
+		return
+	}
+
+	d.send(addr, krpcMsg{"t": tid, "y": "r", "r": r})
+	d.addNode(id, addr)
+}
+
+func (d *DHT) sendError(tid string, addr *net.UDPAddr, code int, text string) {
+	d.send(addr, krpcMsg{"t": tid, "y": "e", "e": []interface{}{code, text}})
+}
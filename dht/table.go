@@ -0,0 +1,199 @@
+package dht
+
+import (
+	"bytes"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+NOTES
+- The routing table has one bucket per length of the id prefix a node
+  shares with ours, so there are lots of buckets close to us and the far
+  away half of the id space shares a single one
+- A bucket holds at most K nodes ordered from least to most recently seen.
+  A node that failed to answer a couple of queries in a row is bad and the
+  first to be replaced when the bucket is full
+*/
+
+const K = 8
+const MAX_FAILURES = 2
+const NODE_STALE_AFTER = 15 * time.Minute
+
+type node struct {
+	id       [20]byte
+	addr     *net.UDPAddr
+	lastSeen time.Time
+	failures int
+}
+
+func (n *node) isBad() bool {
+	return n.failures >= MAX_FAILURES
+}
+
+func distance(a, b [20]byte) [20]byte {
+	var d [20]byte
+	for i := range a {
+		d[i] = a[i] ^ b[i]
+	}
+	return d
+}
+
+// note: true if a is closer to target than b
+func closer(target, a, b [20]byte) bool {
+	da := distance(target, a)
+	db := distance(target, b)
+	return bytes.Compare(da[:], db[:]) < 0
+}
+
+func commonPrefixLen(a, b [20]byte) int {
+	for i := range a {
+		x := a[i] ^ b[i]
+		if x == 0 {
+			continue
+		}
+		for bit := 0; bit < 8; bit++ {
+			if x&(0x80>>bit) != 0 {
+				return i*8 + bit
+			}
+		}
+	}
+	return 160
+}
+
+type routingTable struct {
+	mu      sync.Mutex
+	self    [20]byte
+	buckets [161][]*node
+}
+
+func newRoutingTable(self [20]byte) *routingTable {
+	return &routingTable{self: self}
+}
+
+func (rt *routingTable) bucketFor(id [20]byte) int {
+	return commonPrefixLen(rt.self, id)
+}
+
+/*
+note: records that we heard from a node. returns the least recently seen
+node of a full bucket (a copy) when the new node couldn't be placed, the
+caller pings it and calls replace if it doesn't answer
+*/
+func (rt *routingTable) insert(id [20]byte, addr *net.UDPAddr) *node {
+	if id == rt.self {
+		return nil
+	}
+
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	b := rt.bucketFor(id)
+	bucket := rt.buckets[b]
+
+	for i, n := range bucket {
+		if n.id == id {
+			n.addr = addr
+			n.lastSeen = time.Now()
+			n.failures = 0
+			rt.buckets[b] = append(append(bucket[:i:i], bucket[i+1:]...), n)
+			return nil
+		}
+	}
+
+	fresh := &node{id: id, addr: addr, lastSeen: time.Now()}
+
+	if len(bucket) < K {
+		rt.buckets[b] = append(bucket, fresh)
+		return nil
+	}
+
+	for i, n := range bucket {
+		if n.isBad() {
+			rt.buckets[b] = append(append(bucket[:i:i], bucket[i+1:]...), fresh)
+			return nil
+		}
+	}
+
+	oldest := *bucket[0]
+	return &oldest
+}
+
+func (rt *routingTable) replace(old *node, id [20]byte, addr *net.UDPAddr) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	b := rt.bucketFor(old.id)
+	bucket := rt.buckets[b]
+
+	for i, n := range bucket {
+		if n.id == old.id {
+			rt.buckets[b] = append(append(bucket[:i:i], bucket[i+1:]...), &node{id: id, addr: addr, lastSeen: time.Now()})
+			return
+		}
+	}
+}
+
+func (rt *routingTable) failed(id [20]byte) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	for _, n := range rt.buckets[rt.bucketFor(id)] {
+		if n.id == id {
+			n.failures++
+			return
+		}
+	}
+}
+
+func (rt *routingTable) closest(target [20]byte, count int) []*node {
+	rt.mu.Lock()
+	all := []*node{}
+	for _, bucket := range rt.buckets {
+		for _, n := range bucket {
+			if !n.isBad() {
+				copied := *n
+				all = append(all, &copied)
+			}
+		}
+	}
+	rt.mu.Unlock()
+
+	sort.Slice(all, func(i, j int) bool {
+		return closer(target, all[i].id, all[j].id)
+	})
+
+	return all[:min(count, len(all))]
+}
+
+func (rt *routingTable) size() int {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	count := 0
+	for _, bucket := range rt.buckets {
+		count += len(bucket)
+	}
+	return count
+}
+
+// note: buckets nobody was heard from in a while, they get a refresh lookup
+func (rt *routingTable) staleBuckets() []int {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	stale := []int{}
+	for b, bucket := range rt.buckets {
+		if len(bucket) == 0 {
+			continue
+		}
+
+		newest := bucket[len(bucket)-1].lastSeen
+		if time.Since(newest) > NODE_STALE_AFTER {
+			stale = append(stale, b)
+		}
+	}
+	return stale
+}
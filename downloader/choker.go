@@ -0,0 +1,138 @@
+package downloader
+
+import (
+	"context"
+	"math/rand"
+	"sort"
+	"time"
+	"torry/client"
+)
+
+/*
+NOTES
+- Tit-for-tat: every round the interested peers that gave us the most
+  (download rate while leeching, upload rate once we're seeding) are
+  unchoked and everyone else is choked
+- One extra peer is unchoked at random regardless of its rate and rotated
+  every few rounds, that's how new peers get a chance to prove themselves
+*/
+
+const UNCHOKE_SLOTS = 4
+const CHOKE_INTERVAL = 10 * time.Second
+const OPTIMISTIC_UNCHOKE_ROUNDS = 3
+
+type choker struct {
+	round      int
+	optimistic *client.Client
+}
+
+func (t *Torrent) clientsSnapshot() []*client.Client {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	clients := make([]*client.Client, 0, len(t.clients))
+	for c := range t.clients {
+		clients = append(clients, c)
+	}
+	return clients
+}
+
+func (t *Torrent) runChoker(ctx context.Context) {
+	ch := choker{}
+	ticker := time.NewTicker(CHOKE_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			ch.rechoke(t)
+		}
+	}
+}
+
+func (ch *choker) rechoke(t *Torrent) {
+	clients := t.clientsSnapshot()
+	seeding := t.isComplete()
+
+	interested := []*client.Client{}
+	optimisticConnected := false
+	for _, c := range clients {
+		c.SampleRates()
+		if c.Interested.Load() {
+			interested = append(interested, c)
+		}
+		if c == ch.optimistic {
+			optimisticConnected = true
+		}
+	}
+
+	rate := func(c *client.Client) float64 {
+		if seeding {
+			return c.UploadRate()
+		}
+		return c.DownloadRate()
+	}
+
+	sort.Slice(interested, func(i, j int) bool {
+		return rate(interested[i]) > rate(interested[j])
+	})
+
+	unchoke := map[*client.Client]bool{}
+	for i := 0; i < len(interested) && i < UNCHOKE_SLOTS; i++ {
+		unchoke[interested[i]] = true
+	}
+
+	// note: rotate the optimistic unchoke every few rounds or when its peer is gone
+	rotate := ch.round%OPTIMISTIC_UNCHOKE_ROUNDS == 0 || !optimisticConnected || !ch.optimistic.Interested.Load()
+	if rotate {
+		ch.optimistic = nil
+
+		candidates := []*client.Client{}
+		for _, c := range interested {
+			if !unchoke[c] {
+				candidates = append(candidates, c)
+			}
+		}
+		if len(candidates) > 0 {
+			ch.optimistic = candidates[rand.Intn(len(candidates))]
+		}
+	}
+	if ch.optimistic != nil {
+		unchoke[ch.optimistic] = true
+	}
+	ch.round++
+
+	for _, c := range clients {
+		if unchoke[c] && c.AmChoking.Load() {
+			c.SendUnchoke()
+		} else if !unchoke[c] && !c.AmChoking.Load() {
+			c.SendChoke()
+			c.ClearRequests()
+		}
+	}
+}
+
+/*
+note: a peer that becomes interested while there are free slots doesn't
+have to wait for the next round
+*/
+func (t *Torrent) onInterested(c *client.Client) error {
+	if !c.AmChoking.Load() {
+		return nil
+	}
+
+	unchoked := 0
+	for _, other := range t.clientsSnapshot() {
+		if !other.AmChoking.Load() {
+			unchoked++
+		}
+	}
+
+	if unchoked >= UNCHOKE_SLOTS {
+		return nil
+	}
+
+	return c.SendUnchoke()
+}
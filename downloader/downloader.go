@@ -2,17 +2,32 @@ package downloader
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha1"
 	"fmt"
-	"log"
+	"sync"
+	"sync/atomic"
 	"time"
+	"torry/bitfield"
 	"torry/client"
+	"torry/events"
 	"torry/message"
 	"torry/peers"
+	"torry/ratelimit"
+	"torry/storage"
 )
 
 const MAX_BACKLOG = 5
 const MAX_BLOCK_SIZE = 16384
+const IDLE_POLL_INTERVAL = 5 * time.Second
+const PIECE_POLL_INTERVAL = time.Second
+
+/*
+note: how long a piece may go without a block arriving from the peer. it's
+not a limit on the whole piece, with a low rate limit a piece can take far
+longer than this and still be making progress
+*/
+const PIECE_TIMEOUT = 30 * time.Second
 
 type Torrent struct {
 	Peers       []peers.Peer
@@ -22,12 +37,42 @@ type Torrent struct {
 	PieceLength int
 	Length      int
 	Name        string
-}
-
-type pieceWork struct {
-	index  int
-	hash   [20]byte
-	length int
+	Files       []storage.File
+	ResumePath  string
+	Private     bool
+	Events      *events.Bus
+
+	// note: how many peers to be connected to at once, 0 means MAX_CONNECTIONS
+	MaxConnections int
+
+	/*
+		note: bandwidth caps of this torrent on top of the global ones in
+		ratelimit, nil means no cap of its own. the rates can be changed
+		while downloading
+	*/
+	DownloadLimit *ratelimit.Limiter
+	UploadLimit   *ratelimit.Limiter
+
+	// note: set up by Download, shared with inbound connections and uploads
+	mu      sync.Mutex
+	store   *storage.Storage
+	have    bitfield.Bitfield
+	clients map[*client.Client]bool
+	picker  *picker
+	results chan *pieceResult
+	pool    *peerPool
+	pexSeen map[*client.Client]time.Time
+
+	// note: piece payload bytes moved this session, what trackers get reported
+	downloaded atomic.Int64
+	uploaded   atomic.Int64
+
+	// note: see lifecycle.go
+	ctx     context.Context
+	paused  bool
+	stopped bool
+	workers sync.WaitGroup
+	done    chan struct{}
 }
 
 type pieceResult struct {
@@ -35,13 +80,18 @@ type pieceResult struct {
 	buf   []byte
 }
 
+/*
+note: a pieceProgress with a nil piece is used while there is nothing to
+download from the peer, it still answers the peer's messages
+*/
 type pieceProgress struct {
-	index      int
-	client     *client.Client
-	buf        []byte
-	downloaded int
-	requested  int
-	backlog    int
+	torrent  *Torrent
+	client   *client.Client
+	piece    *activePiece
+	complete bool
+
+	// note: set whenever a block of the piece came in, the piece deadline moves on
+	progressed bool
 }
 
 func (state *pieceProgress) readMessage() error {
@@ -59,103 +109,242 @@ func (state *pieceProgress) readMessage() error {
 		state.client.Choked = false
 	case message.MsgChoke:
 		state.client.Choked = true
+		if state.piece != nil {
+			state.piece.forgetRequests(state.client)
+		}
 	case message.MsgHave:
 		index, err := message.ParseHave(msg)
 		if err != nil {
 			return err
 		}
-		state.client.Bitfield.SetPiece(index)
+		if !state.client.Bitfield.HasPiece(index) {
+			state.client.Bitfield.SetPiece(index)
+			// note: a short bitfield can't hold the piece, don't count what we can't take back
+			if state.client.Bitfield.HasPiece(index) {
+				state.torrent.picker.addHave(index)
+			}
+		}
+	case message.MsgBitfield:
+		state.torrent.picker.removeBitfield(state.client.Bitfield)
+		state.client.Bitfield = msg.Payload
+		state.torrent.picker.addBitfield(state.client.Bitfield)
+	case message.MsgInterested:
+		state.client.Interested.Store(true)
+		return state.torrent.onInterested(state.client)
+	case message.MsgNotInterested:
+		state.client.Interested.Store(false)
+	case message.MsgRequest:
+		return state.torrent.handleRequest(state.client, msg)
+	case message.MsgCancel:
+		index, begin, length, err := message.ParseRequest(msg)
+		if err != nil {
+			return err
+		}
+		state.client.CancelRequest(client.BlockRequest{Index: index, Begin: begin, Length: length})
 	case message.MsgPiece:
-		n, err := message.ParsePiece(state.index, state.buf, msg)
+		if state.piece == nil {
+			return nil
+		}
+		cancels, complete, n, err := state.piece.receive(state.client, msg)
+		if err != nil {
+			return err
+		}
+		state.client.RecordDownload(n)
+		state.torrent.downloaded.Add(int64(n))
+		if n > 0 {
+			state.progressed = true
+		}
+		for _, req := range cancels {
+			req.client.SendCancel(state.piece.index, req.begin, req.length)
+		}
+		if complete {
+			state.complete = true
+		}
+	case message.MsgExtended:
+		extID, payload, err := message.ParseExtended(msg)
 		if err != nil {
 			return err
 		}
-		state.downloaded += n
-		state.backlog--
+		if extID == message.ExtUtPex {
+			return state.torrent.handlePex(state.client, payload)
+		}
+		return state.client.HandleExtended(msg)
 	}
 	return nil
 }
 
-func attemptDownloadPiece(c *client.Client, pw *pieceWork) ([]byte, error) {
+/*
+note: returns true if this worker delivered the last block of the piece and
+false if the piece was finished (or given up on) by someone else
+*/
+func (t *Torrent) attemptDownloadPiece(c *client.Client, ap *activePiece) (bool, error) {
 	state := pieceProgress{
-		index:  pw.index,
-		client: c,
-		buf:    make([]byte, pw.length),
+		torrent: t,
+		client:  c,
+		piece:   ap,
 	}
 
-	c.Conn.SetDeadline(time.Now().Add(time.Second * 30))
+	deadline := time.Now().Add(PIECE_TIMEOUT)
+	c.Conn.SetWriteDeadline(deadline)
 	defer c.Conn.SetDeadline(time.Time{})
 
-	for state.downloaded < pw.length {
+	for !ap.isDone() {
 		if !state.client.Choked {
-			for state.backlog < MAX_BACKLOG && state.requested < pw.length {
-				blockSize := min(pw.length-state.requested, MAX_BLOCK_SIZE)
+			for ap.outstanding(c) < MAX_BACKLOG {
+				begin, length, ok := ap.nextRequest(c)
+				if !ok {
+					break
+				}
 
-				err := c.SendRequest(pw.index, state.requested, blockSize)
+				err := c.SendRequest(ap.index, begin, length)
 				if err != nil {
-					return nil, err
+					return false, err
 				}
+			}
+		}
 
-				state.backlog++
-				state.requested += blockSize
+		/*
+			note: in endgame the blocks we wait for may arrive from another
+			peer (and get cancelled here), so don't block on the read and
+			keep checking whether the piece is already done
+		*/
+		ready, err := c.Poll(PIECE_POLL_INTERVAL)
+		if err != nil {
+			return false, err
+		}
+		if !ready {
+			if time.Now().After(deadline) {
+				return false, fmt.Errorf("timed out waiting for piece [%d]", ap.index)
 			}
+			continue
 		}
 
-		err := state.readMessage()
+		c.Conn.SetReadDeadline(deadline)
+		err = state.readMessage()
 		if err != nil {
-			return nil, err
+			return false, err
+		}
+
+		if state.progressed {
+			state.progressed = false
+			deadline = time.Now().Add(PIECE_TIMEOUT)
+			c.Conn.SetWriteDeadline(deadline)
+		}
+
+		if state.complete {
+			return true, nil
 		}
 	}
 
-	return state.buf, nil
+	return false, nil
 }
 
-func checkIntegrity(pw *pieceWork, buf []byte) error {
-	hash := sha1.Sum(buf)
+func checkIntegrity(ap *activePiece) error {
+	hash := sha1.Sum(ap.buf)
 
-	if !bytes.Equal(hash[:], pw.hash[:]) {
-		return fmt.Errorf("piece index [%d] failed integrity check", pw.index)
+	if !bytes.Equal(hash[:], ap.hash[:]) {
+		return fmt.Errorf("piece index [%d] failed integrity check", ap.index)
 	}
 
 	return nil
 }
 
-func (t *Torrent) startDownloadWorker(peer peers.Peer, workQueue chan *pieceWork, results chan *pieceResult) {
-	c, err := client.New(peer, t.InfoHash, t.PeerID)
-	if err != nil {
-		// 	fmt.Println(err.Error())
-		// fmt.Printf("Could not complete handshake. Disconnecting. peer: %s", peer.Stringify())
+// note: shared by the connections we open and the ones the listener hands us
+func (t *Torrent) runPeer(c *client.Client) {
+	defer c.Close()
+
+	// note: a peer with nothing yet may never send a bitfield, haves fill this in
+	if len(c.Bitfield) == 0 {
+		c.Bitfield = bitfield.New(len(t.PieceHashes))
+	}
+
+	if !t.addClient(c) {
 		return
 	}
+	c.SetDownloadLimits(ratelimit.GlobalDownload, t.DownloadLimit)
+	t.Events.Publish(events.PeerConnected{Peer: c.Peer})
 
-	defer c.Conn.Close()
-	// fmt.Printf("Completed Handshake. peer: %s\n", peer.Stringify())
+	err := t.exchange(c)
+	t.removeClient(c)
 
-	c.SendInterested()
+	// note: pausing and stopping close connections on purpose, nothing to report
+	if t.isPaused() || t.ctx.Err() != nil {
+		err = nil
+	}
+	t.Events.Publish(events.PeerDisconnected{Peer: c.Peer, Err: err})
+}
+
+// note: downloads from the peer while there is anything left, then seeds to it until the connection ends
+func (t *Torrent) exchange(c *client.Client) error {
+	t.workers.Add(2)
+	go func() {
+		defer t.workers.Done()
+		t.serveUploads(c)
+	}()
+	go func() {
+		defer t.workers.Done()
+		t.runPex(c)
+	}()
+
+	if !t.isComplete() {
+		c.SendInterested()
+	}
+
+	t.picker.addBitfield(c.Bitfield)
+	defer func() { t.picker.removeBitfield(c.Bitfield) }()
+
+	idle := pieceProgress{
+		torrent: t,
+		client:  c,
+	}
 
-	for pw := range workQueue {
-		if !c.Bitfield.HasPiece(pw.index) {
-			workQueue <- pw
+	for !t.isComplete() {
+		ap, ok := t.picker.pick(c.Bitfield, c)
+		if !ok {
+			/*
+				note: the peer has nothing we still need (or someone else is
+				on it already). keep answering its messages and check again
+				every so often, a have or a piece given back may change that
+			*/
+			ready, err := c.Poll(IDLE_POLL_INTERVAL)
+			if err != nil {
+				return err
+			}
+			if ready {
+				err = idle.readMessage()
+				if err != nil {
+					return err
+				}
+			}
 			continue
 		}
 
-		buf, err := attemptDownloadPiece(c, pw)
+		complete, err := t.attemptDownloadPiece(c, ap)
+		t.picker.leave(ap, c)
 		if err != nil {
-			log.Println("Exiting", err)
-			workQueue <- pw
-			return
+			return err
+		}
+
+		if !complete {
+			continue
 		}
 
-		err = checkIntegrity(pw, buf)
+		err = checkIntegrity(ap)
 		if err != nil {
-			log.Printf("Piece #%d failed integrity check\n", pw.index)
-			workQueue <- pw
+			t.Events.Publish(events.PieceFailed{Index: ap.index})
+			t.blame(ap)
+			t.picker.fail(ap)
 			continue
 		}
 
-		c.SendHave(pw.index)
-		results <- &pieceResult{pw.index, buf}
+		select {
+		case t.results <- &pieceResult{ap.index, ap.buf}:
+		case <-t.ctx.Done():
+			return nil
+		}
 	}
+
+	return t.seed(c)
 }
 
 func (t *Torrent) calculateBounds(index int) (bagin int, end int) {
@@ -170,36 +359,199 @@ func (t *Torrent) calculatePieceSize(index int) int {
 	return end - begin
 }
 
-func (t *Torrent) Download(progressChan *chan float64, buffChan *chan []byte) ([]byte, error) {
-	// log.Println("Starting Download for", t.Name)
+// note: false once the torrent is paused or stopped, the connection should go
+func (t *Torrent) addClient(c *client.Client) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.paused || t.stopped {
+		return false
+	}
+
+	t.clients[c] = true
+	return true
+}
+
+func (t *Torrent) removeClient(c *client.Client) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.clients, c)
+	delete(t.pexSeen, c)
+}
+
+func (t *Torrent) haveSnapshot() bitfield.Bitfield {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return append(bitfield.Bitfield{}, t.have...)
+}
+
+func (t *Torrent) hasPiece(index int) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.have.HasPiece(index)
+}
+
+func (t *Torrent) isComplete() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.have.Count() == len(t.PieceHashes)
+}
+
+// note: marks the piece as ours and tells every connected peer about it
+func (t *Torrent) completePiece(index int) {
+	t.mu.Lock()
+	t.have.SetPiece(index)
+	clients := make([]*client.Client, 0, len(t.clients))
+	for c := range t.clients {
+		clients = append(clients, c)
+	}
+	t.mu.Unlock()
 
-	workQueue := make(chan *pieceWork, len(t.PieceHashes))
-	results := make(chan *pieceResult)
-	for index, hash := range t.PieceHashes {
-		length := t.calculatePieceSize(index)
-		workQueue <- &pieceWork{index, hash, length}
+	for _, c := range clients {
+		c.SendHave(index)
 	}
+}
 
-	for _, peer := range t.Peers {
-		go t.startDownloadWorker(peer, workQueue, results)
+// note: bytes uploaded and downloaded so far and the bytes of the pieces we still miss
+func (t *Torrent) Stats() (uploaded, downloaded, left int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	left = t.Length
+	if t.have != nil {
+		for i := range t.PieceHashes {
+			if t.have.HasPiece(i) {
+				left -= t.calculatePieceSize(i)
+			}
+		}
 	}
 
-	buf := make([]byte, t.Length)
-	donePieces := 0
+	return int(t.uploaded.Load()), int(t.downloaded.Load()), left
+}
+
+/*
+note: peers can turn up while the download is running (trackers, DHT, PEX,
+LSD), they all go into the pool. before Download starts they are just added
+to Peers
+*/
+func (t *Torrent) AddPeers(list []peers.Peer) {
+	t.mu.Lock()
+	pool := t.pool
+	if pool == nil {
+		t.Peers = append(t.Peers, list...)
+	}
+	t.mu.Unlock()
+
+	if pool != nil {
+		pool.add(list)
+	}
+}
+
+// note: changes MaxConnections, also while the download is running
+func (t *Torrent) SetMaxConnections(max int) {
+	t.mu.Lock()
+	pool := t.pool
+	if pool == nil {
+		t.MaxConnections = max
+	}
+	t.mu.Unlock()
+
+	if pool != nil {
+		pool.setMax(max)
+	}
+}
+
+/*
+note: returns once every piece is on disk, the torrent keeps seeding until
+ctx is cancelled. cancelling it earlier returns ctx's error after everything
+was shut down (see lifecycle.go). progress goes out on Events
+*/
+func (t *Torrent) Download(ctx context.Context) error {
+	t.mu.Lock()
+	t.ctx = ctx
+	t.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		t.teardown()
+	}()
+
+	/*
+		note: the storage stays open once the download is done, the pieces
+		are still served to other peers from it
+	*/
+	store, err := storage.Open(t.Files)
+	if err != nil {
+		return err
+	}
+
+	have := t.loadPieces(store)
+	donePieces := have.Count()
+	t.Events.Publish(events.Checked{Have: donePieces, Total: len(t.PieceHashes)})
+
+	// note: only the pieces that didn't pass the recheck are handed out
+	t.mu.Lock()
+	if t.stopped {
+		t.mu.Unlock()
+		store.Close()
+		return ctx.Err()
+	}
+	t.store = store
+	t.have = have
+	t.clients = map[*client.Client]bool{}
+	t.picker = newPicker(t.PieceHashes, t.calculatePieceSize, have)
+	t.results = make(chan *pieceResult)
+	t.pool = newPeerPool(t.MaxConnections)
+	t.pool.add(t.Peers)
+	t.pexSeen = map[*client.Client]time.Time{}
+	t.mu.Unlock()
+
+	go t.runChoker(ctx)
+	go t.runPeerPool(ctx)
+	go t.runRates(ctx)
 
 	for donePieces < len(t.PieceHashes) {
-		res := <-results
-		begin, end := t.calculateBounds(res.index)
-		copy(buf[begin:end], res.buf)
+		var res *pieceResult
+		select {
+		case res = <-t.results:
+		case <-ctx.Done():
+			<-t.Done()
+			return ctx.Err()
+		}
+		begin, _ := t.calculateBounds(res.index)
+
+		// note: verified pieces go straight to disk, only in-flight pieces are held in memory
+		_, err := store.WriteAt(res.buf, int64(begin))
+		if err != nil {
+			if ctx.Err() != nil {
+				<-t.Done()
+				return ctx.Err()
+			}
+			return err
+		}
+		t.picker.done(res.index)
+		t.completePiece(res.index)
 		donePieces++
 
-		*progressChan <- float64(donePieces) / float64(len(t.PieceHashes)) * 100
-		*buffChan <- buf[begin:end]
-		// numWorkers := runtime.NumGoroutine() - 1
-		// log.Printf("(%0.2f%%) Downloaded piece #%d from %d peers\n", percent, res.index, numWorkers)
+		if donePieces%RESUME_SAVE_EVERY == 0 {
+			err = t.saveResume(store, t.haveSnapshot())
+			if err != nil {
+				t.Events.Publish(events.Error{Err: fmt.Errorf("could not save resume file: %w", err)})
+			}
+		}
+
+		t.Events.Publish(events.PieceCompleted{Index: res.index, Have: donePieces, Total: len(t.PieceHashes)})
 	}
 
-	close(workQueue)
+	err = t.saveResume(store, t.haveSnapshot())
+	if err != nil {
+		return err
+	}
 
-	return buf, nil
+	t.Events.Publish(events.Completed{})
+	return nil
 }
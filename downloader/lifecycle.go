@@ -0,0 +1,118 @@
+package downloader
+
+import (
+	"fmt"
+	"torry/bitfield"
+	"torry/client"
+	"torry/events"
+)
+
+/*
+NOTES
+- Pausing drops every peer connection and refuses new ones until Resume,
+  what we have so far is written to the resume file. The pieces that were
+  in flight are given back to the picker as their workers exit
+- Cancelling the context of Download stops the torrent for good: the
+  connections are closed, every worker is waited for, the resume file is
+  saved and the storage closed. Done is closed once all of that happened
+*/
+
+// note: counts a goroutine that works on a connection, false if the torrent isn't taking any
+func (t *Torrent) startWorker() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.stopped || t.paused || t.store == nil {
+		return false
+	}
+
+	t.workers.Add(1)
+	return true
+}
+
+func (t *Torrent) isPaused() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.paused
+}
+
+func (t *Torrent) Paused() bool {
+	return t.isPaused()
+}
+
+func (t *Torrent) Pause() error {
+	t.mu.Lock()
+	if t.paused || t.stopped {
+		t.mu.Unlock()
+		return nil
+	}
+	t.paused = true
+	clients := make([]*client.Client, 0, len(t.clients))
+	for c := range t.clients {
+		clients = append(clients, c)
+	}
+	store := t.store
+	have := append(bitfield.Bitfield{}, t.have...)
+	t.mu.Unlock()
+
+	for _, c := range clients {
+		c.Close()
+	}
+
+	if store == nil {
+		return nil
+	}
+	return t.saveResume(store, have)
+}
+
+func (t *Torrent) Resume() {
+	t.mu.Lock()
+	paused := t.paused
+	t.paused = false
+	pool := t.pool
+	t.mu.Unlock()
+
+	if paused && pool != nil {
+		pool.forgive()
+	}
+}
+
+// note: closed once the torrent was stopped and everything is cleaned up
+func (t *Torrent) Done() <-chan struct{} {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.done == nil {
+		t.done = make(chan struct{})
+	}
+	return t.done
+}
+
+func (t *Torrent) teardown() {
+	t.mu.Lock()
+	t.stopped = true
+	clients := make([]*client.Client, 0, len(t.clients))
+	for c := range t.clients {
+		clients = append(clients, c)
+	}
+	store := t.store
+	have := append(bitfield.Bitfield{}, t.have...)
+	t.mu.Unlock()
+
+	for _, c := range clients {
+		c.Close()
+	}
+	t.workers.Wait()
+
+	if store != nil {
+		err := t.saveResume(store, have)
+		if err != nil {
+			t.Events.Publish(events.Error{Err: fmt.Errorf("could not save resume file: %w", err)})
+		}
+		store.Close()
+	}
+
+	t.Done()
+	close(t.done)
+}
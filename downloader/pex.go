@@ -0,0 +1,124 @@
+package downloader
+
+import (
+	"time"
+	"torry/client"
+	"torry/peers"
+	"torry/pex"
+)
+
+/*
+NOTES
+- Every peer that speaks ut_pex gets told about the other peers we're
+  connected to once a minute, only what changed since the last message
+- Peers learned this way go into the pool like any other, except seeds
+  once we're seeding ourselves. private torrents don't exchange peers
+*/
+
+const PEX_INTERVAL = time.Minute
+
+func (t *Torrent) runPex(c *client.Client) {
+	if t.Private {
+		return
+	}
+
+	ticker := time.NewTicker(PEX_INTERVAL)
+	defer ticker.Stop()
+
+	// note: what this peer has been told about so far, by address
+	sent := map[string]peers.Peer{}
+
+	for {
+		select {
+		case <-c.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if !c.SupportsExtension("ut_pex") {
+			continue
+		}
+
+		msg := pex.Message{}
+		current := map[string]bool{}
+
+		for _, other := range t.clientsSnapshot() {
+			if other == c {
+				continue
+			}
+
+			addr, ok := other.ListenAddr()
+			if !ok {
+				continue
+			}
+
+			key := addr.Stringify()
+			current[key] = true
+			if _, ok := sent[key]; ok || len(msg.Added) >= pex.MAX_PEERS {
+				continue
+			}
+
+			var flags byte
+			if !other.Inbound {
+				flags |= pex.FLAG_REACHABLE
+			}
+			msg.Added = append(msg.Added, pex.Peer{Peer: addr, Flags: flags})
+			sent[key] = addr
+		}
+
+		for key, addr := range sent {
+			if !current[key] && len(msg.Dropped) < pex.MAX_PEERS {
+				msg.Dropped = append(msg.Dropped, addr)
+				delete(sent, key)
+			}
+		}
+
+		if len(msg.Added) == 0 && len(msg.Dropped) == 0 {
+			continue
+		}
+
+		payload, err := pex.Encode(msg)
+		if err != nil {
+			continue
+		}
+
+		err = c.SendExtended("ut_pex", payload)
+		if err != nil {
+			return
+		}
+	}
+}
+
+// note: a peer sending more often than it should only gets heard every half interval
+func (t *Torrent) handlePex(c *client.Client, payload []byte) error {
+	if t.Private {
+		return nil
+	}
+
+	t.mu.Lock()
+	last, ok := t.pexSeen[c]
+	if ok && time.Since(last) < PEX_INTERVAL/2 {
+		t.mu.Unlock()
+		return nil
+	}
+	t.pexSeen[c] = time.Now()
+	seeding := t.have.Count() == len(t.PieceHashes)
+	t.mu.Unlock()
+
+	msg, err := pex.Decode(payload)
+	if err != nil {
+		// note: a garbled peer list isn't worth dropping the connection over
+		return nil
+	}
+
+	candidates := []peers.Peer{}
+	for _, p := range msg.Added {
+		if seeding && p.IsSeed() {
+			continue
+		}
+		candidates = append(candidates, p.Peer)
+	}
+
+	t.AddPeers(candidates)
+	return nil
+}
@@ -0,0 +1,229 @@
+package downloader
+
+import (
+	"math/rand"
+	"sync"
+	"torry/bitfield"
+	"torry/client"
+)
+
+/*
+NOTES
+- Rarest first: availability counts how many connected peers have each
+  piece, built from their bitfields and haves. A peer is always handed the
+  piece it has that the fewest other peers have, ties are broken at random
+- A piece is missing, active (some worker is on it) or done. Only missing
+  pieces are handed out, a worker that gives up puts its piece back
+- Endgame: once no piece is missing anymore the last active pieces are
+  handed out again to any other peer that has them, so a slow peer can't
+  hold up the end of the download
+*/
+
+type pieceState uint8
+
+const (
+	pieceMissing pieceState = iota
+	pieceActive
+	pieceDone
+)
+
+type picker struct {
+	mu           sync.Mutex
+	hashes       [][20]byte
+	pieceSize    func(index int) int
+	availability []int
+	state        []pieceState
+	missing      int
+	active       map[int]*activePiece
+}
+
+func newPicker(hashes [][20]byte, pieceSize func(index int) int, have bitfield.Bitfield) *picker {
+	p := picker{
+		hashes:       hashes,
+		pieceSize:    pieceSize,
+		availability: make([]int, len(hashes)),
+		state:        make([]pieceState, len(hashes)),
+		active:       map[int]*activePiece{},
+	}
+
+	for i := range hashes {
+		if have.HasPiece(i) {
+			p.state[i] = pieceDone
+		} else {
+			p.missing++
+		}
+	}
+
+	return &p
+}
+
+func (p *picker) addBitfield(bf bitfield.Bitfield) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for i := range p.availability {
+		if bf.HasPiece(i) {
+			p.availability[i]++
+		}
+	}
+}
+
+func (p *picker) removeBitfield(bf bitfield.Bitfield) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for i := range p.availability {
+		if bf.HasPiece(i) {
+			p.availability[i]--
+		}
+	}
+}
+
+func (p *picker) addHave(index int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if index >= 0 && index < len(p.availability) {
+		p.availability[index]++
+	}
+}
+
+/*
+note: returns the rarest missing piece the peer has and marks it active.
+in endgame it returns an active piece the peer has that c isn't on yet,
+preferring the ones with the fewest workers
+*/
+func (p *picker) pick(bf bitfield.Bitfield, c *client.Client) (*activePiece, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.missing == 0 {
+		return p.pickEndgame(bf, c)
+	}
+
+	best := -1
+	ties := 0
+	for i, state := range p.state {
+		if state != pieceMissing || !bf.HasPiece(i) {
+			continue
+		}
+
+		switch {
+		case best == -1 || p.availability[i] < p.availability[best]:
+			best = i
+			ties = 1
+		case p.availability[i] == p.availability[best]:
+			// note: reservoir sampling, every tied piece ends up equally likely
+			ties++
+			if rand.Intn(ties) == 0 {
+				best = i
+			}
+		}
+	}
+
+	if best == -1 {
+		return nil, false
+	}
+
+	ap := newActivePiece(best, p.hashes[best], p.pieceSize(best))
+	ap.workers[c] = true
+
+	p.state[best] = pieceActive
+	p.missing--
+	p.active[best] = ap
+
+	return ap, true
+}
+
+func (p *picker) pickEndgame(bf bitfield.Bitfield, c *client.Client) (*activePiece, bool) {
+	var best *activePiece
+	bestWorkers := 0
+	ties := 0
+
+	for index, ap := range p.active {
+		if !bf.HasPiece(index) {
+			continue
+		}
+
+		ap.mu.Lock()
+		joinable := !ap.finished && ap.remaining > 0 && !ap.workers[c]
+		workers := len(ap.workers)
+		ap.mu.Unlock()
+
+		if !joinable {
+			continue
+		}
+
+		switch {
+		case best == nil || workers < bestWorkers:
+			best = ap
+			bestWorkers = workers
+			ties = 1
+		case workers == bestWorkers:
+			ties++
+			if rand.Intn(ties) == 0 {
+				best = ap
+			}
+		}
+	}
+
+	if best == nil {
+		return nil, false
+	}
+
+	best.mu.Lock()
+	best.workers[c] = true
+	best.mu.Unlock()
+
+	return best, true
+}
+
+/*
+note: c is done with the piece, whether it finished it or not. when the
+last worker walks away from an unfinished piece it is missing again
+*/
+func (p *picker) leave(ap *activePiece, c *client.Client) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	ap.mu.Lock()
+	defer ap.mu.Unlock()
+
+	delete(ap.workers, c)
+	delete(ap.requested, c)
+
+	if len(ap.workers) > 0 || ap.finished || ap.remaining == 0 || p.active[ap.index] != ap {
+		return
+	}
+
+	ap.finished = true
+	delete(p.active, ap.index)
+	p.state[ap.index] = pieceMissing
+	p.missing++
+}
+
+// note: the piece failed its integrity check, everyone on it stops and it starts over
+func (p *picker) fail(ap *activePiece) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	ap.mu.Lock()
+	ap.finished = true
+	ap.mu.Unlock()
+
+	if p.active[ap.index] != ap {
+		return
+	}
+
+	delete(p.active, ap.index)
+	p.state[ap.index] = pieceMissing
+	p.missing++
+}
+
+func (p *picker) done(index int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.active, index)
+	p.state[index] = pieceDone
+}
@@ -0,0 +1,177 @@
+package downloader
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"torry/client"
+	"torry/message"
+)
+
+/*
+NOTES
+- An activePiece holds the buffer of a piece that is being downloaded
+  together with which of its blocks arrived and which blocks every worker
+  on it has asked its peer for
+- Normally one worker owns a piece. In endgame several workers ask their
+  peers for the same blocks, whichever block arrives first is kept and the
+  other peers get a cancel for it
+*/
+
+type blockRequest struct {
+	client *client.Client
+	begin  int
+	length int
+}
+
+type activePiece struct {
+	index  int
+	hash   [20]byte
+	length int
+
+	mu        sync.Mutex
+	buf       []byte
+	received  []bool
+	remaining int
+	requested map[*client.Client]map[int]bool
+	workers   map[*client.Client]bool
+	finished  bool
+
+	// note: every peer a block of the piece came from, they share the blame for a bad piece
+	contributors map[*client.Client]bool
+}
+
+func newActivePiece(index int, hash [20]byte, length int) *activePiece {
+	blocks := (length + MAX_BLOCK_SIZE - 1) / MAX_BLOCK_SIZE
+
+	ap := activePiece{
+		index:     index,
+		hash:      hash,
+		length:    length,
+		buf:       make([]byte, length),
+		received:  make([]bool, blocks),
+		remaining: blocks,
+		requested: map[*client.Client]map[int]bool{},
+		workers:   map[*client.Client]bool{},
+
+		contributors: map[*client.Client]bool{},
+	}
+
+	return &ap
+}
+
+func (ap *activePiece) blockBounds(block int) (begin int, length int) {
+	begin = block * MAX_BLOCK_SIZE
+	return begin, min(ap.length-begin, MAX_BLOCK_SIZE)
+}
+
+// note: the piece is over once every block arrived or it was given up on
+func (ap *activePiece) isDone() bool {
+	ap.mu.Lock()
+	defer ap.mu.Unlock()
+
+	return ap.finished || ap.remaining == 0
+}
+
+func (ap *activePiece) outstanding(c *client.Client) int {
+	ap.mu.Lock()
+	defer ap.mu.Unlock()
+
+	return len(ap.requested[c])
+}
+
+// note: the next block c should ask for, one that hasn't arrived and c hasn't asked for yet
+func (ap *activePiece) nextRequest(c *client.Client) (begin int, length int, ok bool) {
+	ap.mu.Lock()
+	defer ap.mu.Unlock()
+
+	if ap.finished {
+		return 0, 0, false
+	}
+
+	for block, got := range ap.received {
+		if got || ap.requested[c][block] {
+			continue
+		}
+
+		if ap.requested[c] == nil {
+			ap.requested[c] = map[int]bool{}
+		}
+		ap.requested[c][block] = true
+
+		begin, length = ap.blockBounds(block)
+		return begin, length, true
+	}
+
+	return 0, 0, false
+}
+
+/*
+note: copies a block into the piece. returns the requests other peers
+still have open for that block (they should be cancelled), whether this
+block was the last one missing and how many bytes were read
+*/
+func (ap *activePiece) receive(c *client.Client, msg *message.Message) ([]blockRequest, bool, int, error) {
+	if len(msg.Payload) < 8 {
+		return nil, false, 0, fmt.Errorf("too short ! (that's what she said): [%d]", len(msg.Payload))
+	}
+
+	// note: blocks of a piece we moved on from (cancelled, endgame) can still show up
+	if int(binary.BigEndian.Uint32(msg.Payload[0:4])) != ap.index {
+		return nil, false, 0, nil
+	}
+
+	begin := int(binary.BigEndian.Uint32(msg.Payload[4:8]))
+	if begin%MAX_BLOCK_SIZE != 0 {
+		return nil, false, 0, fmt.Errorf("block offset [%d] is not block aligned", begin)
+	}
+
+	ap.mu.Lock()
+	defer ap.mu.Unlock()
+
+	block := begin / MAX_BLOCK_SIZE
+	delete(ap.requested[c], block)
+
+	if block >= len(ap.received) || ap.received[block] || ap.finished {
+		return nil, false, 0, nil
+	}
+
+	n, err := message.ParsePiece(ap.index, ap.buf, msg)
+	if err != nil {
+		return nil, false, 0, err
+	}
+
+	ap.received[block] = true
+	ap.remaining--
+	ap.contributors[c] = true
+
+	cancels := []blockRequest{}
+	for other, blocks := range ap.requested {
+		if blocks[block] {
+			delete(blocks, block)
+			_, length := ap.blockBounds(block)
+			cancels = append(cancels, blockRequest{other, begin, length})
+		}
+	}
+
+	return cancels, ap.remaining == 0, n, nil
+}
+
+// note: a choked peer throws away our requests, so they have to be asked again later
+func (ap *activePiece) forgetRequests(c *client.Client) {
+	ap.mu.Lock()
+	defer ap.mu.Unlock()
+
+	delete(ap.requested, c)
+}
+
+func (ap *activePiece) contributorList() []*client.Client {
+	ap.mu.Lock()
+	defer ap.mu.Unlock()
+
+	list := make([]*client.Client, 0, len(ap.contributors))
+	for c := range ap.contributors {
+		list = append(list, c)
+	}
+	return list
+}
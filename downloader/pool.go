@@ -0,0 +1,260 @@
+package downloader
+
+import (
+	"context"
+	"sync"
+	"time"
+	"torry/client"
+	"torry/peers"
+)
+
+/*
+NOTES
+- The pool keeps every peer address we heard of (trackers, DHT, PEX, LSD)
+  and keeps up to MaxConnections of them connected. Inbound peers count
+  against the same limit
+- A peer that couldn't be reached or dropped us soon after connecting is
+  tried again later, waiting twice as long every time. After
+  MAX_CONNECT_FAILURES in a row it's forgotten
+- Peers that sent data for pieces that failed the hash check are banned by
+  IP after BAN_AFTER_HASH_FAILURES, they aren't dialed or accepted again
+*/
+
+const MAX_CONNECTIONS = 50
+const POOL_INTERVAL = 5 * time.Second
+const RECONNECT_BACKOFF = 30 * time.Second
+const MAX_RECONNECT_BACKOFF = 30 * time.Minute
+const MAX_CONNECT_FAILURES = 8
+const BAN_AFTER_HASH_FAILURES = 3
+
+// note: a connection that lasted this long was a good one, its failures are forgiven
+const STABLE_CONNECTION = 2 * time.Minute
+
+type candidate struct {
+	peer        peers.Peer
+	connected   bool
+	failures    int
+	nextAttempt time.Time
+}
+
+type peerPool struct {
+	mu           sync.Mutex
+	max          int
+	active       int
+	candidates   map[string]*candidate
+	hashFailures map[string]int
+	banned       map[string]bool
+	wake         chan struct{}
+}
+
+func newPeerPool(max int) *peerPool {
+	if max <= 0 {
+		max = MAX_CONNECTIONS
+	}
+
+	return &peerPool{
+		max:          max,
+		candidates:   map[string]*candidate{},
+		hashFailures: map[string]int{},
+		banned:       map[string]bool{},
+		wake:         make(chan struct{}, 1),
+	}
+}
+
+func (pp *peerPool) add(list []peers.Peer) {
+	pp.mu.Lock()
+	for _, peer := range list {
+		addr := peer.Stringify()
+		if _, ok := pp.candidates[addr]; ok || pp.banned[peer.IP.String()] {
+			continue
+		}
+		pp.candidates[addr] = &candidate{peer: peer}
+	}
+	pp.mu.Unlock()
+
+	select {
+	case pp.wake <- struct{}{}:
+	default:
+	}
+}
+
+// note: candidates that are due for a connection attempt, as many as there are free slots
+func (pp *peerPool) due() []*candidate {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+
+	now := time.Now()
+	ready := []*candidate{}
+
+	for _, cand := range pp.candidates {
+		if pp.active >= pp.max {
+			break
+		}
+		if cand.connected || now.Before(cand.nextAttempt) {
+			continue
+		}
+
+		cand.connected = true
+		pp.active++
+		ready = append(ready, cand)
+	}
+
+	return ready
+}
+
+/*
+note: the connection to a candidate is over. connectedFor is how long it
+was up, 0 if it never came up
+*/
+func (pp *peerPool) release(cand *candidate, connectedFor time.Duration) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+
+	cand.connected = false
+	pp.active--
+
+	if connectedFor >= STABLE_CONNECTION {
+		cand.failures = 0
+	} else {
+		cand.failures++
+	}
+
+	if cand.failures >= MAX_CONNECT_FAILURES {
+		delete(pp.candidates, cand.peer.Stringify())
+		return
+	}
+
+	backoff := min(RECONNECT_BACKOFF<<min(cand.failures, 10), MAX_RECONNECT_BACKOFF)
+	cand.nextAttempt = time.Now().Add(backoff)
+}
+
+// note: after a pause every candidate gets a clean slate, the dropped connections weren't their fault
+func (pp *peerPool) forgive() {
+	pp.mu.Lock()
+	for _, cand := range pp.candidates {
+		cand.failures = 0
+		cand.nextAttempt = time.Time{}
+	}
+	pp.mu.Unlock()
+
+	select {
+	case pp.wake <- struct{}{}:
+	default:
+	}
+}
+
+/*
+note: raising the limit lets the pool connect to more peers right away.
+lowering it doesn't drop anyone, the connections over it just aren't
+replaced when they close
+*/
+func (pp *peerPool) setMax(max int) {
+	pp.mu.Lock()
+	if max <= 0 {
+		max = MAX_CONNECTIONS
+	}
+	pp.max = max
+	pp.mu.Unlock()
+
+	select {
+	case pp.wake <- struct{}{}:
+	default:
+	}
+}
+
+// note: takes a slot for a peer that connected to us, false if we're full or it's banned
+func (pp *peerPool) acquireInbound(peer peers.Peer) bool {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+
+	if pp.active >= pp.max || pp.banned[peer.IP.String()] {
+		return false
+	}
+
+	pp.active++
+	return true
+}
+
+func (pp *peerPool) releaseInbound() {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+
+	pp.active--
+}
+
+// note: returns true once the peer crossed the line and got banned
+func (pp *peerPool) hashFailure(peer peers.Peer) bool {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+
+	ip := peer.IP.String()
+	pp.hashFailures[ip]++
+	if pp.hashFailures[ip] < BAN_AFTER_HASH_FAILURES {
+		return false
+	}
+
+	pp.banned[ip] = true
+	for addr, cand := range pp.candidates {
+		if cand.peer.IP.String() == ip {
+			delete(pp.candidates, addr)
+		}
+	}
+	return true
+}
+
+// note: keeps the connection slots filled while there is something left to download
+func (t *Torrent) runPeerPool(ctx context.Context) {
+	ticker := time.NewTicker(POOL_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		if !t.isComplete() && !t.isPaused() {
+			for _, cand := range t.pool.due() {
+				if !t.startWorker() {
+					t.pool.release(cand, 0)
+					continue
+				}
+				go t.connectCandidate(cand)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-t.pool.wake:
+		}
+	}
+}
+
+func (t *Torrent) connectCandidate(cand *candidate) {
+	defer t.workers.Done()
+
+	c, err := client.New(cand.peer, t.InfoHash, t.PeerID, t.haveSnapshot())
+	if err != nil {
+		t.pool.release(cand, 0)
+		return
+	}
+
+	connected := time.Now()
+	t.runPeer(c)
+	t.pool.release(cand, time.Since(connected))
+}
+
+/*
+note: every peer that sent blocks of a piece that failed the hash check
+gets the blame, the banned ones are dropped right away
+*/
+func (t *Torrent) blame(ap *activePiece) {
+	for _, c := range ap.contributorList() {
+		if !t.pool.hashFailure(c.Peer) {
+			continue
+		}
+
+		for _, other := range t.clientsSnapshot() {
+			if other.Peer.IP.Equal(c.Peer.IP) {
+				other.Close()
+			}
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package downloader
+
+import (
+	"context"
+	"time"
+	"torry/events"
+)
+
+const RATES_INTERVAL = time.Second
+
+// note: publishes the transfer rates of the whole torrent every RATES_INTERVAL
+func (t *Torrent) runRates(ctx context.Context) {
+	ticker := time.NewTicker(RATES_INTERVAL)
+	defer ticker.Stop()
+
+	lastDown := t.downloaded.Load()
+	lastUp := t.uploaded.Load()
+	last := time.Now()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			down := t.downloaded.Load()
+			up := t.uploaded.Load()
+			elapsed := now.Sub(last).Seconds()
+
+			t.mu.Lock()
+			connected := len(t.clients)
+			t.mu.Unlock()
+
+			t.Events.Publish(events.Rates{
+				Download: float64(down-lastDown) / elapsed,
+				Upload:   float64(up-lastUp) / elapsed,
+				Peers:    connected,
+			})
+
+			lastDown, lastUp, last = down, up, now
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package downloader
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"os"
+	"torry/bitfield"
+	"torry/storage"
+
+	bencode "github.com/jackpal/bencode-go"
+)
+
+/*
+NOTES
+- The resume file records which pieces were verified together with the size
+  and modification time of every file at the moment it was written
+- If any file changed since then the resume file is ignored and the pieces
+  already on disk are rehashed instead
+*/
+
+const RESUME_SAVE_EVERY = 16
+
+type resumeFileState struct {
+	Length  int64 `bencode:"length"`
+	ModTime int64 `bencode:"mtime"`
+}
+
+type resumeData struct {
+	InfoHash string            `bencode:"info hash"`
+	Bitfield string            `bencode:"bitfield"`
+	Files    []resumeFileState `bencode:"files"`
+}
+
+func (t *Torrent) loadResume(store *storage.Storage) (bitfield.Bitfield, bool) {
+	if t.ResumePath == "" {
+		return nil, false
+	}
+
+	file, err := os.Open(t.ResumePath)
+	if err != nil {
+		return nil, false
+	}
+	defer file.Close()
+
+	rd := resumeData{}
+	err = bencode.Unmarshal(file, &rd)
+	if err != nil {
+		return nil, false
+	}
+
+	states, err := store.Stat()
+	if err != nil {
+		return nil, false
+	}
+
+	if rd.InfoHash != string(t.InfoHash[:]) || len(rd.Files) != len(states) {
+		return nil, false
+	}
+
+	for i, state := range states {
+		if rd.Files[i].Length != state.Length || rd.Files[i].ModTime != state.ModTime {
+			return nil, false
+		}
+	}
+
+	bf := bitfield.New(len(t.PieceHashes))
+	if len(rd.Bitfield) != len(bf) {
+		return nil, false
+	}
+	copy(bf, rd.Bitfield)
+
+	return bf, true
+}
+
+func (t *Torrent) saveResume(store *storage.Storage, bf bitfield.Bitfield) error {
+	if t.ResumePath == "" {
+		return nil
+	}
+
+	states, err := store.Stat()
+	if err != nil {
+		return err
+	}
+
+	rd := resumeData{
+		InfoHash: string(t.InfoHash[:]),
+		Bitfield: string(bf),
+		Files:    make([]resumeFileState, len(states)),
+	}
+	for i, state := range states {
+		rd.Files[i] = resumeFileState{state.Length, state.ModTime}
+	}
+
+	var buff bytes.Buffer
+	err = bencode.Marshal(&buff, rd)
+	if err != nil {
+		return err
+	}
+
+	// note: write then rename so a crash never leaves a half written resume file
+	tmpPath := t.ResumePath + ".tmp"
+	err = os.WriteFile(tmpPath, buff.Bytes(), 0644)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, t.ResumePath)
+}
+
+/*
+note: hashes whatever is already on disk against the piece hashes. pieces
+that can't be read in full (the file is shorter than expected) are missing
+*/
+func (t *Torrent) recheck(store *storage.Storage) bitfield.Bitfield {
+	bf := bitfield.New(len(t.PieceHashes))
+	buf := make([]byte, t.PieceLength)
+
+	for index, hash := range t.PieceHashes {
+		begin, end := t.calculateBounds(index)
+
+		_, err := store.ReadAt(buf[:end-begin], int64(begin))
+		if err != nil {
+			continue
+		}
+
+		if sha1.Sum(buf[:end-begin]) == hash {
+			bf.SetPiece(index)
+		}
+	}
+
+	return bf
+}
+
+func (t *Torrent) loadPieces(store *storage.Storage) bitfield.Bitfield {
+	bf, ok := t.loadResume(store)
+	if ok {
+		return bf
+	}
+
+	return t.recheck(store)
+}
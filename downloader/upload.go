@@ -0,0 +1,112 @@
+package downloader
+
+import (
+	"net"
+	"torry/client"
+	"torry/handshake"
+	"torry/message"
+	"torry/peers"
+	"torry/ratelimit"
+)
+
+/*
+NOTES
+- Peers that connect to us are handed over by the listener once their
+  handshake named this torrent, from then on they are treated exactly like
+  the peers we connected to
+- Blocks are only served from pieces that passed the integrity check and
+  only to peers we aren't choking
+*/
+
+const MAX_REQUEST_LENGTH = 131072
+
+func (t *Torrent) HandleConn(conn net.Conn, hs *handshake.Handshake) {
+	if !t.startWorker() {
+		conn.Close()
+		return
+	}
+	defer t.workers.Done()
+
+	addr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok || !t.pool.acquireInbound(peers.Peer{IP: addr.IP, Port: uint16(addr.Port)}) {
+		conn.Close()
+		return
+	}
+	defer t.pool.releaseInbound()
+
+	c, err := client.Accept(conn, hs, t.PeerID, t.haveSnapshot())
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	t.runPeer(c)
+}
+
+func (t *Torrent) handleRequest(c *client.Client, msg *message.Message) error {
+	index, begin, length, err := message.ParseRequest(msg)
+	if err != nil {
+		return err
+	}
+
+	if c.AmChoking.Load() || !t.hasPiece(index) {
+		return nil
+	}
+
+	if length <= 0 || length > MAX_REQUEST_LENGTH || begin < 0 || begin+length > t.calculatePieceSize(index) {
+		return nil
+	}
+
+	c.QueueRequest(client.BlockRequest{Index: index, Begin: begin, Length: length})
+	return nil
+}
+
+func (t *Torrent) serveUploads(c *client.Client) {
+	for {
+		req, ok := c.NextRequest()
+		if !ok {
+			return
+		}
+
+		// note: waiting our turn here, peers take turns in the order they asked
+		ratelimit.Wait(c.Done(), req.Length, ratelimit.GlobalUpload, t.UploadLimit)
+
+		pieceBegin, _ := t.calculateBounds(req.Index)
+		block := make([]byte, req.Length)
+
+		_, err := t.store.ReadAt(block, int64(pieceBegin+req.Begin))
+		if err != nil {
+			continue
+		}
+
+		// note: the peer may have been choked while the request sat in the queue
+		if c.AmChoking.Load() {
+			continue
+		}
+
+		err = c.SendPiece(req.Index, req.Begin, block)
+		if err != nil {
+			c.Close()
+			return
+		}
+		c.RecordUpload(len(block))
+		t.uploaded.Add(int64(len(block)))
+	}
+}
+
+// note: once there is nothing left to download the connection only serves uploads
+func (t *Torrent) seed(c *client.Client) error {
+	c.SendNotInterested()
+
+	state := pieceProgress{
+		torrent: t,
+		client:  c,
+	}
+
+	for {
+		err := state.readMessage()
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package events
+
+import (
+	"sync"
+	"torry/peers"
+)
+
+/*
+NOTES
+- Everything a frontend may want to show about a running torrent is
+  published as a typed event on a Bus. Subscribers get every event and
+  switch on the types they care about
+- Handlers are called synchronously from whatever goroutine published the
+  event, they should hand it off and return quickly
+*/
+
+type Event interface {
+	event()
+}
+
+// note: what was found on disk when the torrent started
+type Checked struct {
+	Have  int
+	Total int
+}
+
+type PieceCompleted struct {
+	Index int
+	Have  int
+	Total int
+}
+
+type PieceFailed struct {
+	Index int
+}
+
+// note: bytes per second over the last second, Peers is how many we're connected to
+type Rates struct {
+	Download float64
+	Upload   float64
+	Peers    int
+}
+
+type PeerConnected struct {
+	Peer peers.Peer
+}
+
+// note: Err is why the connection ended, nil if we closed it on purpose
+type PeerDisconnected struct {
+	Peer peers.Peer
+	Err  error
+}
+
+// note: Warning is the trackers' "warning message", the announce went through anyway
+type TrackerResponse struct {
+	Interval int
+	Peers    int
+	Warning  string
+	Err      error
+}
+
+// note: something went wrong that didn't stop the torrent, fatal errors come back from Download
+type Error struct {
+	Err error
+}
+
+type Completed struct{}
+
+func (Checked) event()          {}
+func (PieceCompleted) event()   {}
+func (PieceFailed) event()      {}
+func (Rates) event()            {}
+func (PeerConnected) event()    {}
+func (PeerDisconnected) event() {}
+func (TrackerResponse) event()  {}
+func (Error) event()            {}
+func (Completed) event()        {}
+
+// note: percentage of the torrent we have, handy for progress bars
+func (e Checked) Percent() float64 {
+	return percent(e.Have, e.Total)
+}
+
+func (e PieceCompleted) Percent() float64 {
+	return percent(e.Have, e.Total)
+}
+
+func percent(have, total int) float64 {
+	if total == 0 {
+		return 100
+	}
+	return float64(have) / float64(total) * 100
+}
+
+type Handler func(Event)
+
+// note: a nil *Bus is fine to publish on, the events just go nowhere
+type Bus struct {
+	mu       sync.Mutex
+	next     int
+	handlers map[int]Handler
+}
+
+func NewBus() *Bus {
+	return &Bus{handlers: map[int]Handler{}}
+}
+
+// note: returns a function that removes the handler again
+func (b *Bus) Subscribe(h Handler) func() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	id := b.next
+	b.next++
+	b.handlers[id] = h
+
+	return func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		delete(b.handlers, id)
+	}
+}
+
+func (b *Bus) Publish(e Event) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	handlers := make([]Handler, 0, len(b.handlers))
+	for _, h := range b.handlers {
+		handlers = append(handlers, h)
+	}
+	b.mu.Unlock()
+
+	for _, h := range handlers {
+		h(e)
+	}
+}
@@ -11,8 +11,26 @@ NOTES
 - We
 */
 
+/*
+note: the 8 reserved bytes are a bitfield of protocol extensions the sender
+supports. the extension protocol (BEP 10) is bit 20 counted from the right
+*/
+type Reserved [8]byte
+
+const extensionByte = 5
+const extensionBit = 0x10
+
+func (r Reserved) SupportsExtensions() bool {
+	return r[extensionByte]&extensionBit != 0
+}
+
+func (r *Reserved) SetExtensions() {
+	r[extensionByte] |= extensionBit
+}
+
 type Handshake struct {
 	Pstr     string
+	Reserved Reserved
 	InfoHash [20]byte
 	PeerID   [20]byte
 }
@@ -24,7 +42,7 @@ func (h *Handshake) Serialize() []byte {
 	buf[0] = byte(len(h.Pstr))
 	currentIndex := 1 //note: buff[0] is currently holding our pstr length
 	currentIndex += copy(buf[currentIndex:], []byte(h.Pstr))
-	currentIndex += copy(buf[currentIndex:], make([]byte, 8))
+	currentIndex += copy(buf[currentIndex:], h.Reserved[:])
 	currentIndex += copy(buf[currentIndex:], h.InfoHash[:])
 	currentIndex += copy(buf[currentIndex:], h.PeerID[:])
 
@@ -54,12 +72,15 @@ func ReadHandshake(r io.Reader) (*Handshake, error) {
 	}
 
 	var peerID, infoHash [20]byte
+	var reserved Reserved
 
+	copy(reserved[:], handshakeBuff[pstrlen:pstrlen+8])
 	copy(infoHash[:], handshakeBuff[pstrlen+8:pstrlen+8+20])
 	copy(peerID[:], handshakeBuff[pstrlen+8+20:pstrlen+8+20+20])
 
 	h := Handshake{
 		Pstr:     string(handshakeBuff[0:pstrlen]),
+		Reserved: reserved,
 		InfoHash: infoHash,
 		PeerID:   peerID,
 	}
@@ -73,6 +94,7 @@ func New(infohash [20]byte, peerID [20]byte) *Handshake {
 		InfoHash: infohash,
 		PeerID:   peerID,
 	}
+	h.Reserved.SetExtensions()
 
 	return &h
 }
@@ -0,0 +1,99 @@
+package listener
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"time"
+	"torry/handshake"
+)
+
+/*
+NOTES
+- One listener serves every torrent in the process, the infohash in the
+  peer's handshake decides which torrent gets the connection
+- Connections for an infohash nobody registered are dropped
+- Listening on "tcp" without a host takes IPv4 and IPv6 connections alike,
+  IPv4 peers show up with their plain IPv4 address
+*/
+
+type Handler interface {
+	HandleConn(conn net.Conn, hs *handshake.Handshake)
+}
+
+type Listener struct {
+	ln       net.Listener
+	mu       sync.Mutex
+	torrents map[[20]byte]Handler
+}
+
+func Listen(port uint16) (*Listener, error) {
+	ln, err := net.Listen("tcp", net.JoinHostPort("", strconv.Itoa(int(port))))
+	if err != nil {
+		return nil, err
+	}
+
+	l := Listener{
+		ln:       ln,
+		torrents: map[[20]byte]Handler{},
+	}
+
+	go l.acceptLoop()
+
+	return &l, nil
+}
+
+func (l *Listener) Port() uint16 {
+	return uint16(l.ln.Addr().(*net.TCPAddr).Port)
+}
+
+func (l *Listener) Register(infoHash [20]byte, h Handler) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.torrents[infoHash] = h
+}
+
+func (l *Listener) Unregister(infoHash [20]byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.torrents, infoHash)
+}
+
+func (l *Listener) Close() error {
+	return l.ln.Close()
+}
+
+func (l *Listener) acceptLoop() {
+	for {
+		conn, err := l.ln.Accept()
+		if err != nil {
+			return
+		}
+
+		go l.handle(conn)
+	}
+}
+
+func (l *Listener) handle(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	hs, err := handshake.ReadHandshake(conn)
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	l.mu.Lock()
+	h, ok := l.torrents[hs.InfoHash]
+	l.mu.Unlock()
+
+	if !ok {
+		conn.Close()
+		return
+	}
+
+	conn.SetDeadline(time.Time{})
+	h.HandleConn(conn, hs)
+}
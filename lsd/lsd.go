@@ -0,0 +1,249 @@
+package lsd
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"torry/peers"
+)
+
+/*
+NOTES
+- Local Service Discovery (BEP 14) multicasts an HTTP-like BT-SEARCH
+  message on the LAN with our listen port and the infohashes we're on.
+  Anyone else on the network running the same torrents connects to us
+- The cookie lets us recognise (and skip) our own announces coming back
+  from the multicast group
+- Every torrent is announced when it's registered and then every
+  ANNOUNCE_INTERVAL, never more than once a minute
+*/
+
+const ANNOUNCE_INTERVAL = 5 * time.Minute
+const MIN_ANNOUNCE_INTERVAL = time.Minute
+
+var (
+	GroupV4 = &net.UDPAddr{IP: net.IPv4(239, 192, 152, 143), Port: 6771}
+	GroupV6 = &net.UDPAddr{IP: net.ParseIP("ff15::efc0:988f"), Port: 6771}
+)
+
+type torrent struct {
+	onPeer       func(peers.Peer)
+	lastAnnounce time.Time
+}
+
+type Service struct {
+	port   int
+	cookie string
+
+	// note: one multicast socket per IP version we could join, either may be missing
+	groups []*net.UDPAddr
+	recv   []*net.UDPConn
+	send   []*net.UDPConn
+
+	mu       sync.Mutex
+	torrents map[[20]byte]*torrent
+	closed   chan struct{}
+}
+
+/*
+note: joins the multicast groups and starts announcing. port is the port
+we accept peer connections on
+*/
+func Start(port int) (*Service, error) {
+	cookie := make([]byte, 8)
+	_, err := rand.Read(cookie)
+	if err != nil {
+		return nil, err
+	}
+
+	s := Service{
+		port:     port,
+		cookie:   hex.EncodeToString(cookie),
+		torrents: map[[20]byte]*torrent{},
+		closed:   make(chan struct{}),
+	}
+
+	for _, group := range []*net.UDPAddr{GroupV4, GroupV6} {
+		network := "udp4"
+		if group.IP.To4() == nil {
+			network = "udp6"
+		}
+
+		recv, err := net.ListenMulticastUDP(network, nil, group)
+		if err != nil {
+			continue
+		}
+
+		send, err := net.ListenUDP(network, nil)
+		if err != nil {
+			recv.Close()
+			continue
+		}
+
+		s.groups = append(s.groups, group)
+		s.recv = append(s.recv, recv)
+		s.send = append(s.send, send)
+		go s.readLoop(recv)
+	}
+
+	if len(s.recv) == 0 {
+		return nil, errors.New("could not join any local service discovery group")
+	}
+
+	go s.announceLoop()
+
+	return &s, nil
+}
+
+// note: onPeer is called for every LAN peer that announces the infohash
+func (s *Service) Register(infoHash [20]byte, onPeer func(peers.Peer)) {
+	s.mu.Lock()
+	s.torrents[infoHash] = &torrent{onPeer: onPeer}
+	s.mu.Unlock()
+
+	s.announce()
+}
+
+func (s *Service) Unregister(infoHash [20]byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.torrents, infoHash)
+}
+
+func (s *Service) Close() error {
+	select {
+	case <-s.closed:
+		return nil
+	default:
+		close(s.closed)
+	}
+
+	for i := range s.recv {
+		s.recv[i].Close()
+		s.send[i].Close()
+	}
+	return nil
+}
+
+func (s *Service) announceLoop() {
+	ticker := time.NewTicker(MIN_ANNOUNCE_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.closed:
+			return
+		case <-ticker.C:
+			s.announce()
+		}
+	}
+}
+
+// note: sends one message with every torrent that's due
+func (s *Service) announce() {
+	s.mu.Lock()
+	due := [][20]byte{}
+	for infoHash, t := range s.torrents {
+		if time.Since(t.lastAnnounce) >= ANNOUNCE_INTERVAL {
+			t.lastAnnounce = time.Now()
+			due = append(due, infoHash)
+		}
+	}
+	s.mu.Unlock()
+
+	if len(due) == 0 {
+		return
+	}
+
+	for i, group := range s.groups {
+		s.send[i].WriteToUDP(s.formatAnnounce(group, due), group)
+	}
+}
+
+func (s *Service) formatAnnounce(group *net.UDPAddr, infoHashes [][20]byte) []byte {
+	var buff bytes.Buffer
+
+	fmt.Fprintf(&buff, "BT-SEARCH * HTTP/1.1\r\n")
+	fmt.Fprintf(&buff, "Host: %s\r\n", group.String())
+	fmt.Fprintf(&buff, "Port: %d\r\n", s.port)
+	for _, infoHash := range infoHashes {
+		fmt.Fprintf(&buff, "Infohash: %s\r\n", hex.EncodeToString(infoHash[:]))
+	}
+	fmt.Fprintf(&buff, "cookie: %s\r\n", s.cookie)
+	fmt.Fprintf(&buff, "\r\n\r\n")
+
+	return buff.Bytes()
+}
+
+func (s *Service) readLoop(conn *net.UDPConn) {
+	buf := make([]byte, 1500)
+
+	for {
+		n, addr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-s.closed:
+				return
+			default:
+				continue
+			}
+		}
+
+		s.handleAnnounce(buf[:n], addr)
+	}
+}
+
+func (s *Service) handleAnnounce(packet []byte, addr *net.UDPAddr) {
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(packet)))
+	if err != nil || req.Method != "BT-SEARCH" {
+		return
+	}
+
+	if req.Header.Get("Cookie") == s.cookie {
+		return
+	}
+
+	port, err := strconv.Atoi(req.Header.Get("Port"))
+	if err != nil || port <= 0 || port > 65535 {
+		return
+	}
+
+	peer := peers.Peer{IP: addr.IP, Port: uint16(port)}
+
+	for _, value := range req.Header.Values("Infohash") {
+		infoHash, ok := parseInfoHash(value)
+		if !ok {
+			continue
+		}
+
+		s.mu.Lock()
+		t, ok := s.torrents[infoHash]
+		s.mu.Unlock()
+
+		if ok {
+			t.onPeer(peer)
+		}
+	}
+}
+
+func parseInfoHash(value string) ([20]byte, bool) {
+	var infoHash [20]byte
+
+	raw, err := hex.DecodeString(strings.TrimSpace(value))
+	if err != nil || len(raw) != 20 {
+		return infoHash, false
+	}
+
+	copy(infoHash[:], raw)
+	return infoHash, true
+}
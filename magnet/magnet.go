@@ -0,0 +1,119 @@
+package magnet
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"torry/peers"
+)
+
+/*
+NOTES
+- magnet:?xt=urn:btih:<infohash>&dn=<name>&tr=<tracker>&x.pe=<host:port>
+- The infohash is either 40 hex characters or 32 base32 characters
+- tr and x.pe can show up more than once
+*/
+
+type Magnet struct {
+	InfoHash [20]byte
+	Name     string
+	Trackers []string
+	Peers    []peers.Peer
+}
+
+func parseInfoHash(xt string) ([20]byte, error) {
+	var infoHash [20]byte
+
+	if !strings.HasPrefix(xt, "urn:btih:") {
+		return infoHash, fmt.Errorf("unsupported exact topic %q", xt)
+	}
+	encoded := strings.TrimPrefix(xt, "urn:btih:")
+
+	var decoded []byte
+	var err error
+
+	switch len(encoded) {
+	case 40:
+		decoded, err = hex.DecodeString(encoded)
+	case 32:
+		decoded, err = base32.StdEncoding.DecodeString(strings.ToUpper(encoded))
+	default:
+		return infoHash, fmt.Errorf("infohash %q has unexpected length [%d]", encoded, len(encoded))
+	}
+	if err != nil {
+		return infoHash, err
+	}
+
+	copy(infoHash[:], decoded)
+	return infoHash, nil
+}
+
+func parsePeer(addr string) (peers.Peer, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return peers.Peer{}, err
+	}
+
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return peers.Peer{}, err
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		ips, err := net.LookupIP(host)
+		if err != nil || len(ips) == 0 {
+			return peers.Peer{}, fmt.Errorf("could not resolve peer %q", addr)
+		}
+		ip = ips[0]
+	}
+
+	return peers.Peer{IP: ip, Port: uint16(port)}, nil
+}
+
+func Parse(uri string) (Magnet, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return Magnet{}, err
+	}
+
+	if u.Scheme != "magnet" {
+		return Magnet{}, fmt.Errorf("expected a magnet link but got scheme %q", u.Scheme)
+	}
+
+	params := u.Query()
+
+	m := Magnet{
+		Name:     params.Get("dn"),
+		Trackers: params["tr"],
+	}
+
+	found := false
+	for _, xt := range params["xt"] {
+		infoHash, err := parseInfoHash(xt)
+		if err != nil {
+			continue
+		}
+		m.InfoHash = infoHash
+		found = true
+		break
+	}
+	if !found {
+		return Magnet{}, fmt.Errorf("magnet link has no btih exact topic")
+	}
+
+	// note: a peer that can't be parsed or resolved is just skipped
+	for _, addr := range params["x.pe"] {
+		peer, err := parsePeer(addr)
+		if err != nil {
+			continue
+		}
+		m.Peers = append(m.Peers, peer)
+	}
+
+	return m, nil
+}
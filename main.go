@@ -1,12 +1,19 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"os"
 	"strconv"
 	"strings"
+	"torry/downloader"
+	"torry/events"
+	"torry/ratelimit"
 	"torry/torrentfile"
+	"torry/tracker"
 
 	"github.com/charmbracelet/bubbles/progress"
 	"github.com/charmbracelet/bubbles/spinner"
@@ -49,63 +56,100 @@ const rawHeader = `
    ╚═╝    ╚═════╝ ╚═╝  ╚═╝╚═╝  ╚═╝   ╚═╝
 `
 
-type progressMsg float64
+// note: events of the running torrent, forwarded into the program by the bus subscription in main
+type eventMsg struct {
+	events.Event
+}
 
 type model struct {
-	err          error
-	tf           torrentfile.TorrentFile
-	selectedTf   string
-	started      bool
-	progress     float64
-	progressChan chan float64
-	buffChan     chan []byte
-	progressBar  progress.Model
-	spinner      spinner.Model
+	err         error
+	tf          torrentfile.TorrentFile
+	selectedTf  string
+	started     bool
+	progress    float64
+	bus         *events.Bus
+	handle      *torrentfile.Handle
+	paused      bool
+	completed   bool
+	rates       events.Rates
+	tracker     string
+	swarm       string
+	downLimit   int
+	upLimit     int
+	progressBar progress.Model
+	spinner     spinner.Model
+
+	// note: this torrent's own caps on top of the global ones, limitTorrent picks which of the two the keys change
+	torrentDown  int
+	torrentUp    int
+	limitTorrent bool
+
+	// note: how many peers this torrent may be connected to, the < > keys change it
+	maxPeers int
 }
 
 type clearErrorMsg struct{}
 
-func clearError() tea.Cmd {
+type startedMsg struct {
+	handle *torrentfile.Handle
+	err    error
+}
+
+// note: a private torrent announces to its trackers before it starts, that can take a while so it runs off the UI loop
+func startDownload(tf torrentfile.TorrentFile, bus *events.Bus, down, up, maxPeers int) tea.Cmd {
 	return func() tea.Msg {
-		return clearErrorMsg{}
+		h, err := tf.Start(context.Background(), bus)
+		if err == nil {
+			h.SetDownloadLimit(down)
+			h.SetUploadLimit(up)
+			h.SetMaxConnections(maxPeers)
+		}
+		return startedMsg{h, err}
 	}
 }
 
-func watchProgress(ch chan float64) tea.Cmd {
+func clearError() tea.Cmd {
 	return func() tea.Msg {
-		p, ok := <-ch
-		if !ok {
-			return nil
-		}
-		return progressMsg(p)
+		return clearErrorMsg{}
 	}
 }
 
-func initialModel(filepath string) model {
-	tf, err := torrentfile.OpenTorrentFile(filepath)
+func initialModel(filepath string, bus *events.Bus, torrentDown, torrentUp, maxPeers int) model {
+	var tf torrentfile.TorrentFile
+	var err error
+
+	if strings.HasPrefix(filepath, "magnet:") {
+		fmt.Println("Fetching metadata for magnet link...")
+		tf, err = torrentfile.OpenMagnet(filepath)
+	} else {
+		tf, err = torrentfile.OpenTorrentFile(filepath)
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	pc := make(chan float64, 100)
-	bc := make(chan []byte)
 	s := spinner.New()
 	s.Spinner = spinner.Dot
 
 	return model{
-		tf:           tf,
-		selectedTf:   filepath,
-		started:      false,
-		progress:     0,
-		progressChan: pc,
-		buffChan:     bc,
-		progressBar:  progress.New(progress.WithDefaultGradient()),
-		spinner:      s,
+		tf:          tf,
+		selectedTf:  filepath,
+		started:     false,
+		progress:    0,
+		bus:         bus,
+		swarm:       "scraping...",
+		downLimit:   ratelimit.GlobalDownload.Rate(),
+		upLimit:     ratelimit.GlobalUpload.Rate(),
+		progressBar: progress.New(progress.WithDefaultGradient()),
+		spinner:     s,
+		torrentDown: torrentDown,
+		torrentUp:   torrentUp,
+		maxPeers:    maxPeers,
 	}
 }
 
 func (m model) Init() tea.Cmd {
-	return tea.Batch(tea.SetWindowTitle("TORRY"), m.spinner.Tick)
+	return tea.Batch(tea.SetWindowTitle("TORRY"), m.spinner.Tick, scrapeSwarm(m.tf))
 }
 
 func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
@@ -124,22 +168,96 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		case "d":
 			if !m.started {
 				m.started = true
+				return m, startDownload(m.tf, m.bus, m.torrentDown, m.torrentUp, m.maxPeers)
+			}
+
+		case "p":
+			if m.handle == nil {
+				return m, nil
+			}
+
+			if m.paused {
+				m.handle.Resume()
+				m.paused = false
+			} else {
+				err := m.handle.Pause()
+				if err != nil {
+					m.err = err
+				}
+				m.paused = true
+			}
 
-				go func() {
-					for range m.buffChan {
-					}
-				}()
+		case "t":
+			m.limitTorrent = !m.limitTorrent
+
+		// note: limits of a torrent that isn't started yet are applied once it is
+		case "[", "]":
+			if m.limitTorrent {
+				m.torrentDown = stepLimit(m.torrentDown, msg.String() == "]")
+				if m.handle != nil {
+					m.handle.SetDownloadLimit(m.torrentDown)
+				}
+			} else {
+				m.downLimit = stepLimit(m.downLimit, msg.String() == "]")
+				ratelimit.GlobalDownload.SetRate(m.downLimit)
+			}
+
+		case "{", "}":
+			if m.limitTorrent {
+				m.torrentUp = stepLimit(m.torrentUp, msg.String() == "}")
+				if m.handle != nil {
+					m.handle.SetUploadLimit(m.torrentUp)
+				}
+			} else {
+				m.upLimit = stepLimit(m.upLimit, msg.String() == "}")
+				ratelimit.GlobalUpload.SetRate(m.upLimit)
+			}
 
-				go func() {
-					err := m.tf.D2f(&m.progressChan, &m.buffChan)
-					if err != nil {
-						log.Fatal(err)
-					}
-					close(m.progressChan)
-				}()
+		case "<", ">":
+			m.maxPeers = stepPeers(m.maxPeers, msg.String() == ">")
+			if m.handle != nil {
+				m.handle.SetMaxConnections(m.maxPeers)
+			}
+		}
 
-				return m, watchProgress(m.progressChan)
+	case scrapeMsg:
+		if msg.err != nil {
+			m.swarm = "scrape failed"
+		} else {
+			m.swarm = formatScrape(msg.result)
+		}
+
+	case startedMsg:
+		if msg.err != nil {
+			log.Fatal(msg.err)
+		}
+		m.handle = msg.handle
+
+	case eventMsg:
+		switch e := msg.Event.(type) {
+		case events.Checked:
+			return m, m.setProgress(e.Percent())
+		case events.PieceCompleted:
+			return m, m.setProgress(e.Percent())
+		case events.Rates:
+			m.rates = e
+		case events.TrackerResponse:
+			var failure *tracker.FailureError
+			switch {
+			case errors.As(e.Err, &failure):
+				m.tracker = "announce refused: " + failure.Reason
+			case e.Err != nil:
+				m.tracker = "announce failed"
+			default:
+				m.tracker = fmt.Sprintf("%d peers, next announce in %ds", e.Peers, e.Interval)
+			}
+			if e.Warning != "" {
+				m.tracker += " (" + e.Warning + ")"
 			}
+		case events.Error:
+			m.err = e.Err
+		case events.Completed:
+			m.completed = true
 		}
 
 	case spinner.TickMsg:
@@ -147,11 +265,6 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		m.spinner, cmd = m.spinner.Update(msg)
 		return m, cmd
 
-	case progressMsg:
-		m.progress = float64(msg)
-		cmd := m.progressBar.SetPercent(float64(msg) / 100)
-		return m, tea.Batch(watchProgress(m.progressChan), cmd)
-
 	case progress.FrameMsg:
 		progressModel, cmd := m.progressBar.Update(msg)
 		m.progressBar = progressModel.(progress.Model)
@@ -164,6 +277,11 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	return m, cmd
 }
 
+func (m *model) setProgress(percent float64) tea.Cmd {
+	m.progress = percent
+	return m.progressBar.SetPercent(percent / 100)
+}
+
 func (m model) View() string {
 	var b strings.Builder
 
@@ -185,7 +303,8 @@ func (m model) View() string {
 	b.WriteString(m.selectedTf + "\n\n")
 
 	b.WriteString(labelStyle.Render("Announce URL: "))
-	b.WriteString(m.tf.Announce + "\n\n")
+	b.WriteString(m.tf.Announce + "   ")
+	b.WriteString(hintStyle.Render(m.swarm) + "\n\n")
 
 	b.WriteString(labelStyle.Render("Name: "))
 	b.WriteString(m.tf.Name + "\n\n")
@@ -201,27 +320,155 @@ func (m model) View() string {
 		b.WriteString(hintStyle.Render(hint))
 		b.WriteString("\n\n")
 	} else {
-		progressLine := m.spinner.View() + " Downloading: " + m.progressBar.View()
+		status := m.spinner.View() + " Downloading: "
+		if m.paused {
+			status = "  Paused: "
+		} else if m.completed {
+			status = m.spinner.View() + " Seeding: "
+		}
+		progressLine := status + m.progressBar.View()
 		b.WriteString(subtitleStyle.Render(progressLine))
 		b.WriteString("\n\n")
+
+		b.WriteString(labelStyle.Render("Peers: "))
+		b.WriteString(fmt.Sprintf("%d/%d   ", m.rates.Peers, m.maxPeers))
+		b.WriteString(labelStyle.Render("Down: "))
+		b.WriteString(formatRate(m.rates.Download) + "   ")
+		b.WriteString(labelStyle.Render("Up: "))
+		b.WriteString(formatRate(m.rates.Upload) + "\n\n")
+
+		global, torrent := "Global", "This torrent"
+		if m.limitTorrent {
+			torrent = "[" + torrent + "]"
+		} else {
+			global = "[" + global + "]"
+		}
+		b.WriteString(labelStyle.Render("Limits: "))
+		b.WriteString(global + " down " + formatLimit(m.downLimit) + ", up " + formatLimit(m.upLimit) + "   ")
+		b.WriteString(torrent + " down " + formatLimit(m.torrentDown) + ", up " + formatLimit(m.torrentUp) + "\n\n")
+
+		if m.tracker != "" {
+			b.WriteString(labelStyle.Render("Tracker: "))
+			b.WriteString(m.tracker + "\n\n")
+		}
 	}
 
 	b.WriteString("\n\n\n")
-	footerText := "␣d␣ Start   ␣q␣ / ␣esc␣ Quit"
+	footerText := "␣d␣ Start   ␣p␣ Pause/Resume   ␣[ ]␣ Down limit   ␣{ }␣ Up limit   ␣t␣ Global/Torrent limits   ␣< >␣ Max peers   ␣q␣ / ␣esc␣ Quit"
 	b.WriteString(footerStyle.Render(footerText))
 
 	return b.String()
 }
 
+func formatRate(bytesPerSec float64) string {
+	switch {
+	case bytesPerSec >= 1<<20:
+		return fmt.Sprintf("%.1f MiB/s", bytesPerSec/(1<<20))
+	case bytesPerSec >= 1<<10:
+		return fmt.Sprintf("%.1f KiB/s", bytesPerSec/(1<<10))
+	default:
+		return fmt.Sprintf("%.0f B/s", bytesPerSec)
+	}
+}
+
+// note: the steps the limit keys go through, 0 (no limit) comes after the last one
+var limitSteps = []int{
+	64 << 10, 128 << 10, 256 << 10, 512 << 10,
+	1 << 20, 2 << 20, 5 << 20, 10 << 20,
+}
+
+func stepLimit(limit int, up bool) int {
+	if up {
+		for _, step := range limitSteps {
+			if limit != 0 && step > limit {
+				return step
+			}
+		}
+		return 0
+	}
+
+	if limit == 0 {
+		return limitSteps[len(limitSteps)-1]
+	}
+	for i := len(limitSteps) - 1; i >= 0; i-- {
+		if limitSteps[i] < limit {
+			return limitSteps[i]
+		}
+	}
+	return limitSteps[0]
+}
+
+const PEERS_STEP = 10
+
+func stepPeers(maxPeers int, up bool) int {
+	if up {
+		return maxPeers + PEERS_STEP
+	}
+	return max(maxPeers-PEERS_STEP, PEERS_STEP)
+}
+
+func formatLimit(bytesPerSec int) string {
+	if bytesPerSec == 0 {
+		return "unlimited"
+	}
+	return formatRate(float64(bytesPerSec))
+}
+
 func main() {
-	if len(os.Args) < 2 {
-		fmt.Println("Use: go run main.go path/to/some.torrent")
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "scrape":
+			runScrape(os.Args[2:])
+			return
+		case "tracker":
+			runTracker(os.Args[2:])
+			return
+		case "create":
+			runCreate(os.Args[2:])
+			return
+		}
+	}
+
+	downLimit := flag.Int("down", 0, "download limit in KiB/s, 0 for none")
+	upLimit := flag.Int("up", 0, "upload limit in KiB/s, 0 for none")
+	torrentDown := flag.Int("torrent-down", 0, "download limit of this torrent in KiB/s, 0 for none")
+	torrentUp := flag.Int("torrent-up", 0, "upload limit of this torrent in KiB/s, 0 for none")
+	maxPeers := flag.Int("max-peers", downloader.MAX_CONNECTIONS, "how many peers to be connected to at once")
+	flag.Usage = func() {
+		fmt.Println("Use: torry [-down KiB/s] [-up KiB/s] [-torrent-down KiB/s] [-torrent-up KiB/s] [-max-peers n] path/to/some.torrent | 'magnet:?xt=urn:btih:...'")
+		fmt.Println("     torry scrape path/to/some.torrent | 'magnet:?xt=urn:btih:...'")
+		fmt.Println("     torry tracker [-addr :6969] [-whitelist infohashes.txt]")
+		fmt.Println("     torry create [-announce url] [-private] ... path/to/file/or/dir")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() < 1 {
+		flag.Usage()
 		os.Exit(1)
 	}
-	inputPath := os.Args[1]
+	inputPath := flag.Arg(0)
 
-	p := tea.NewProgram(initialModel(inputPath), tea.WithAltScreen())
-	if _, err := p.Run(); err != nil {
+	if *maxPeers <= 0 {
+		fmt.Println("-max-peers has to be at least 1")
+		os.Exit(1)
+	}
+
+	ratelimit.GlobalDownload.SetRate(*downLimit * 1024)
+	ratelimit.GlobalUpload.SetRate(*upLimit * 1024)
+
+	bus := events.NewBus()
+	p := tea.NewProgram(initialModel(inputPath, bus, *torrentDown*1024, *torrentUp*1024, *maxPeers), tea.WithAltScreen())
+	bus.Subscribe(func(e events.Event) {
+		p.Send(eventMsg{e})
+	})
+
+	_, err := p.Run()
+
+	// note: stops the download cleanly (resume data, trackers), even if the TUI failed
+	torrentfile.Shutdown()
+
+	if err != nil {
 		fmt.Printf("Error running program: %v\n", err)
 		os.Exit(1)
 	}
@@ -0,0 +1,95 @@
+package message
+
+import (
+	"bytes"
+	"fmt"
+	"torry/rawbencode"
+
+	bencode "github.com/jackpal/bencode-go"
+)
+
+/*
+NOTES
+- Extension protocol (BEP 10) messages all share MsgExtended. The first
+  payload byte is the extended message id, 0 being the extended handshake
+- In the extended handshake every side lists the extensions it supports
+  under "m" together with the id it wants to receive them as, so the id
+  used for sending depends on the peer
+*/
+
+const ExtHandshake = 0
+
+// note: the ids we ask peers to use for the extended messages they send us
+const (
+	ExtUtMetadata = 1
+	ExtUtPex      = 2
+)
+
+var LocalExtensions = map[string]int{
+	"ut_metadata": ExtUtMetadata,
+	"ut_pex":      ExtUtPex,
+}
+
+type ExtendedHandshake struct {
+	M            map[string]int `bencode:"m"`
+	Version      string         `bencode:"v,omitempty"`
+	Port         int            `bencode:"p,omitempty"`
+	Reqq         int            `bencode:"reqq,omitempty"`
+	MetadataSize int            `bencode:"metadata_size,omitempty"`
+}
+
+func FormatExtendedMsg(extID int, payload []byte) *Message {
+	m := Message{
+		ID:      MsgExtended,
+		Payload: append([]byte{byte(extID)}, payload...),
+	}
+
+	return &m
+}
+
+func FormatExtendedHandshakeMsg(eh *ExtendedHandshake) (*Message, error) {
+	var buff bytes.Buffer
+
+	err := bencode.Marshal(&buff, *eh)
+	if err != nil {
+		return nil, err
+	}
+
+	return FormatExtendedMsg(ExtHandshake, buff.Bytes()), nil
+}
+
+func ParseExtended(msg *Message) (int, []byte, error) {
+	if msg.ID != MsgExtended {
+		return 0, nil, fmt.Errorf("expected messageID %d but got %d", MsgExtended, msg.ID)
+	}
+
+	if len(msg.Payload) < 1 {
+		return 0, nil, fmt.Errorf("extended message has an empty payload")
+	}
+
+	return int(msg.Payload[0]), msg.Payload[1:], nil
+}
+
+func ParseExtendedHandshake(msg *Message) (*ExtendedHandshake, error) {
+	extID, payload, err := ParseExtended(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	if extID != ExtHandshake {
+		return nil, fmt.Errorf("expected extended messageID %d but got %d", ExtHandshake, extID)
+	}
+
+	dictEnd, err := rawbencode.ValueEnd(payload, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	eh := ExtendedHandshake{}
+	err = bencode.Unmarshal(bytes.NewReader(payload[:dictEnd]), &eh)
+	if err != nil {
+		return nil, err
+	}
+
+	return &eh, nil
+}
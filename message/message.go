@@ -18,6 +18,7 @@ const (
 	MsgRequest       messageId = 6
 	MsgPiece         messageId = 7
 	MsgCancel        messageId = 8
+	MsgExtended      messageId = 20
 )
 
 type Message struct {
@@ -40,6 +41,37 @@ func FormatRequestMsg(index, begin, length int) *Message {
 	return &m
 }
 
+func FormatCancelMsg(index, begin, length int) *Message {
+	m := FormatRequestMsg(index, begin, length)
+	m.ID = MsgCancel
+
+	return m
+}
+
+func FormatPieceMsg(index, begin int, block []byte) *Message {
+	payload := make([]byte, 8+len(block))
+
+	binary.BigEndian.PutUint32(payload[0:4], uint32(index))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(begin))
+	copy(payload[8:], block)
+
+	m := Message{
+		ID:      MsgPiece,
+		Payload: payload,
+	}
+
+	return &m
+}
+
+func FormatBitfieldMsg(bf []byte) *Message {
+	m := Message{
+		ID:      MsgBitfield,
+		Payload: bf,
+	}
+
+	return &m
+}
+
 func FormatHaveMsg(index int) *Message {
 	payload := make([]byte, 4)
 
@@ -83,6 +115,23 @@ func ParsePiece(index int, buf []byte, msg *Message) (int, error) {
 	return len(data), nil
 }
 
+// note: a cancel message has the same payload as a request
+func ParseRequest(msg *Message) (index, begin, length int, err error) {
+	if msg.ID != MsgRequest && msg.ID != MsgCancel {
+		return 0, 0, 0, fmt.Errorf("expected messageID %d or %d but got %d", MsgRequest, MsgCancel, msg.ID)
+	}
+
+	if len(msg.Payload) != 12 {
+		return 0, 0, 0, fmt.Errorf("expected payload to be 12bytes. got [%d]", len(msg.Payload))
+	}
+
+	index = int(binary.BigEndian.Uint32(msg.Payload[0:4]))
+	begin = int(binary.BigEndian.Uint32(msg.Payload[4:8]))
+	length = int(binary.BigEndian.Uint32(msg.Payload[8:12]))
+
+	return index, begin, length, nil
+}
+
 func ParseHave(msg *Message) (int, error) {
 	if msg.ID != MsgHave {
 		return 0, fmt.Errorf("expected messageID %d but got %d", MsgHave, msg.ID)
@@ -112,6 +161,13 @@ func (m *Message) Serialize() []byte {
 	return buf
 }
 
+/*
+note: the length prefix comes from the peer, anything longer than this is
+refused before allocating. it fits a 128KiB block with its header and the
+bitfield of a torrent with up to two million pieces
+*/
+const MAX_MESSAGE_LENGTH = 256 * 1024
+
 func Read(r io.Reader) (*Message, error) {
 	lenBuf := make([]byte, 4)
 	_, err := io.ReadFull(r, lenBuf)
@@ -125,6 +181,10 @@ func Read(r io.Reader) (*Message, error) {
 		return nil, nil
 	}
 
+	if length > MAX_MESSAGE_LENGTH {
+		return nil, fmt.Errorf("message length %d is over the limit of %d", length, MAX_MESSAGE_LENGTH)
+	}
+
 	buf := make([]byte, length)
 
 	_, err = io.ReadFull(r, buf)
@@ -164,6 +224,8 @@ func (m *Message) name() string {
 		return "Piece"
 	case MsgCancel:
 		return "Cancel"
+	case MsgExtended:
+		return "Extended"
 	default:
 		return fmt.Sprintf("Unknown#%d", m.ID)
 	}
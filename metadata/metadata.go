@@ -0,0 +1,232 @@
+package metadata
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"time"
+	"torry/client"
+	"torry/message"
+	"torry/peers"
+	"torry/rawbencode"
+
+	bencode "github.com/jackpal/bencode-go"
+)
+
+/*
+NOTES
+- A magnet link only carries the infohash, the info dictionary itself has to
+  be fetched from peers with the ut_metadata extension (BEP 9)
+- The info dictionary is split into 16KiB pieces. A piece is requested with
+  {msg_type: 0, piece: i} and comes back as {msg_type: 1, piece: i,
+  total_size: n} followed by the raw piece data in the same message
+- Whatever comes back is only trusted once its sha1 matches the infohash
+*/
+
+const METADATA_PIECE_SIZE = 16384
+const MAX_METADATA_SIZE = 10 * 1024 * 1024
+const MAX_CONCURRENT_FETCHES = 8
+
+const (
+	msgTypeRequest = 0
+	msgTypeData    = 1
+	msgTypeReject  = 2
+)
+
+type metadataMsg struct {
+	MsgType   int `bencode:"msg_type"`
+	Piece     int `bencode:"piece"`
+	TotalSize int `bencode:"total_size,omitempty"`
+}
+
+func sendMetadataMsg(c *client.Client, mm metadataMsg) error {
+	var buff bytes.Buffer
+
+	err := bencode.Marshal(&buff, mm)
+	if err != nil {
+		return err
+	}
+
+	return c.SendExtended("ut_metadata", buff.Bytes())
+}
+
+type fetch struct {
+	client    *client.Client
+	buf       []byte
+	received  []bool
+	remaining int
+}
+
+// note: called once the peer's extended handshake told us the metadata size
+func (f *fetch) start() error {
+	if !f.client.SupportsExtension("ut_metadata") {
+		return errors.New("peer does not support ut_metadata")
+	}
+
+	size := f.client.MetadataSize
+	if size <= 0 || size > MAX_METADATA_SIZE {
+		return fmt.Errorf("peer reported bad metadata size [%d]", size)
+	}
+
+	f.buf = make([]byte, size)
+
+	pieces := (size + METADATA_PIECE_SIZE - 1) / METADATA_PIECE_SIZE
+	f.received = make([]bool, pieces)
+	f.remaining = pieces
+
+	for i := range pieces {
+		err := sendMetadataMsg(f.client, metadataMsg{MsgType: msgTypeRequest, Piece: i})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (f *fetch) handleMetadata(payload []byte) error {
+	if f.buf == nil {
+		return errors.New("got metadata before the extended handshake")
+	}
+
+	// note: the bencoded dict is followed by the raw piece data
+	dictEnd, err := rawbencode.ValueEnd(payload, 0)
+	if err != nil {
+		return err
+	}
+
+	mm := metadataMsg{}
+	err = bencode.Unmarshal(bytes.NewReader(payload[:dictEnd]), &mm)
+	if err != nil {
+		return err
+	}
+
+	switch mm.MsgType {
+	case msgTypeReject:
+		return fmt.Errorf("peer rejected metadata piece [%d]", mm.Piece)
+	case msgTypeData:
+	default:
+		return nil
+	}
+
+	if mm.Piece < 0 || mm.Piece >= len(f.received) {
+		return fmt.Errorf("metadata piece [%d] is out of range", mm.Piece)
+	}
+
+	begin := mm.Piece * METADATA_PIECE_SIZE
+	end := min(begin+METADATA_PIECE_SIZE, len(f.buf))
+	data := payload[dictEnd:]
+	if len(data) != end-begin {
+		return fmt.Errorf("metadata piece [%d] has [%d] bytes, expected [%d]", mm.Piece, len(data), end-begin)
+	}
+
+	if !f.received[mm.Piece] {
+		copy(f.buf[begin:end], data)
+		f.received[mm.Piece] = true
+		f.remaining--
+	}
+
+	return nil
+}
+
+func Fetch(peer peers.Peer, infoHash, peerID [20]byte) ([]byte, error) {
+	c, err := client.Dial(peer, infoHash, peerID)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Conn.Close()
+
+	if !c.Reserved.SupportsExtensions() {
+		return nil, errors.New("peer does not support the extension protocol")
+	}
+
+	err = c.SendExtendedHandshake()
+	if err != nil {
+		return nil, err
+	}
+
+	c.Conn.SetDeadline(time.Now().Add(time.Minute))
+
+	f := fetch{client: c}
+
+	for f.buf == nil || f.remaining > 0 {
+		msg, err := c.Read()
+		if err != nil {
+			return nil, err
+		}
+
+		if msg == nil || msg.ID != message.MsgExtended {
+			continue
+		}
+
+		extID, payload, err := message.ParseExtended(msg)
+		if err != nil {
+			return nil, err
+		}
+
+		switch extID {
+		case message.ExtHandshake:
+			err = c.HandleExtended(msg)
+			if err == nil && f.buf == nil {
+				err = f.start()
+			}
+		case message.ExtUtMetadata:
+			err = f.handleMetadata(payload)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	hash := sha1.Sum(f.buf)
+	if hash != infoHash {
+		return nil, fmt.Errorf("metadata from %s failed integrity check", peer.Stringify())
+	}
+
+	return f.buf, nil
+}
+
+// note: asks a few peers at a time and returns the first verified copy
+func FetchFromPeers(peerList []peers.Peer, infoHash, peerID [20]byte) ([]byte, error) {
+	if len(peerList) == 0 {
+		return nil, errors.New("no peers to fetch metadata from")
+	}
+
+	type fetchResult struct {
+		info []byte
+		err  error
+	}
+
+	results := make(chan fetchResult, len(peerList))
+	sem := make(chan struct{}, MAX_CONCURRENT_FETCHES)
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		for _, peer := range peerList {
+			select {
+			case sem <- struct{}{}:
+			case <-done:
+				return
+			}
+
+			go func() {
+				defer func() { <-sem }()
+				info, err := Fetch(peer, infoHash, peerID)
+				results <- fetchResult{info, err}
+			}()
+		}
+	}()
+
+	var errs []error
+	for range peerList {
+		res := <-results
+		if res.err == nil {
+			return res.info, nil
+		}
+		errs = append(errs, res.err)
+	}
+
+	return nil, fmt.Errorf("could not fetch metadata from any peer: %w", errors.Join(errs...))
+}
@@ -12,11 +12,6 @@ type Peer struct {
 	Port uint16
 }
 
-type TrackerURLResponse struct {
-	Interval int    `bencode:"interval"`
-	Peers    string `bencode:"peers"`
-}
-
 func UnmarshallPeers(peersBin []byte) ([]Peer, error) {
 	const peerSize = 6
 	numPeers := len(peersBin) / peerSize
@@ -33,6 +28,56 @@ func UnmarshallPeers(peersBin []byte) ([]Peer, error) {
 	return peers, nil
 }
 
+// note: the IPv6 compact form (BEP 7), 16 bytes of address and 2 of port per peer
+func UnmarshallPeers6(peersBin []byte) ([]Peer, error) {
+	const peerSize = 18
+	numPeers := len(peersBin) / peerSize
+	if len(peersBin)%peerSize != 0 {
+		err := fmt.Errorf("received malformed IPv6 peers")
+		return nil, err
+	}
+	peers := make([]Peer, numPeers)
+	for i := range numPeers {
+		offset := i * peerSize
+		peers[i].IP = net.IP(peersBin[offset : offset+16])
+		peers[i].Port = binary.BigEndian.Uint16([]byte(peersBin[offset+16 : offset+18]))
+	}
+	return peers, nil
+}
+
 func (p Peer) Stringify() string {
 	return net.JoinHostPort(p.IP.String(), strconv.Itoa(int(p.Port)))
 }
+
+// note: the compact form again, peers without an IPv4 address are left out
+func MarshallPeers(peers []Peer) []byte {
+	buf := make([]byte, 0, len(peers)*6)
+
+	for _, p := range peers {
+		ip := p.IP.To4()
+		if ip == nil {
+			continue
+		}
+
+		buf = append(buf, ip...)
+		buf = binary.BigEndian.AppendUint16(buf, p.Port)
+	}
+
+	return buf
+}
+
+// note: the IPv6 compact form, peers with an IPv4 address (mapped ones too) are left out
+func MarshallPeers6(peers []Peer) []byte {
+	buf := make([]byte, 0, len(peers)*18)
+
+	for _, p := range peers {
+		if p.IP.To4() != nil || len(p.IP) != net.IPv6len {
+			continue
+		}
+
+		buf = append(buf, p.IP...)
+		buf = binary.BigEndian.AppendUint16(buf, p.Port)
+	}
+
+	return buf
+}
@@ -0,0 +1,163 @@
+package pex
+
+import (
+	"bytes"
+	"torry/peers"
+	"torry/rawbencode"
+
+	bencode "github.com/jackpal/bencode-go"
+)
+
+/*
+NOTES
+- Peer exchange (BEP 11) is the ut_pex extended message. It carries the
+  peers the sender connected to ("added") and lost ("dropped") since its
+  last message, in the compact 6 byte form trackers use. IPv6 peers go in
+  "added6"/"dropped6" in the 18 byte form (BEP 7)
+- "added.f" has one flags byte per added peer: prefers encryption, is a
+  seed, supports uTP, supports holepunching, and whether the sender
+  reached it with an outgoing connection
+- A peer should send at most one message a minute with no more than 50
+  added and 50 dropped peers in it
+*/
+
+const MAX_PEERS = 50
+
+const (
+	FLAG_ENCRYPTION = 0x01
+	FLAG_SEED       = 0x02
+	FLAG_UTP        = 0x04
+	FLAG_HOLEPUNCH  = 0x08
+	FLAG_REACHABLE  = 0x10
+)
+
+type Peer struct {
+	peers.Peer
+	Flags byte
+}
+
+func (p Peer) PrefersEncryption() bool {
+	return p.Flags&FLAG_ENCRYPTION != 0
+}
+
+func (p Peer) IsSeed() bool {
+	return p.Flags&FLAG_SEED != 0
+}
+
+func (p Peer) SupportsUTP() bool {
+	return p.Flags&FLAG_UTP != 0
+}
+
+func (p Peer) IsReachable() bool {
+	return p.Flags&FLAG_REACHABLE != 0
+}
+
+type Message struct {
+	Added   []Peer
+	Dropped []peers.Peer
+}
+
+type bencodePex struct {
+	Added    string `bencode:"added"`
+	AddedF   string `bencode:"added.f"`
+	Dropped  string `bencode:"dropped"`
+	Added6   string `bencode:"added6,omitempty"`
+	Added6F  string `bencode:"added6.f,omitempty"`
+	Dropped6 string `bencode:"dropped6,omitempty"`
+}
+
+// note: anything past MAX_PEERS is left out, it can go in the next message
+func Encode(msg Message) ([]byte, error) {
+	added := msg.Added[:min(len(msg.Added), MAX_PEERS)]
+	dropped := msg.Dropped[:min(len(msg.Dropped), MAX_PEERS)]
+
+	addedPeers := make([]peers.Peer, 0, len(added))
+	flags := make([]byte, 0, len(added))
+	addedPeers6 := []peers.Peer{}
+	flags6 := []byte{}
+	for _, p := range added {
+		if p.IP.To4() == nil {
+			addedPeers6 = append(addedPeers6, p.Peer)
+			flags6 = append(flags6, p.Flags)
+			continue
+		}
+		addedPeers = append(addedPeers, p.Peer)
+		flags = append(flags, p.Flags)
+	}
+
+	var buff bytes.Buffer
+	err := bencode.Marshal(&buff, bencodePex{
+		Added:    string(peers.MarshallPeers(addedPeers)),
+		AddedF:   string(flags),
+		Dropped:  string(peers.MarshallPeers(dropped)),
+		Added6:   string(peers.MarshallPeers6(addedPeers6)),
+		Added6F:  string(flags6),
+		Dropped6: string(peers.MarshallPeers6(dropped)),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return buff.Bytes(), nil
+}
+
+/*
+note: a missing or short added.f just means no flags for those peers. a
+peer stuffing more than MAX_PEERS in a message only gets the first ones
+through
+*/
+func Decode(payload []byte) (Message, error) {
+	err := rawbencode.Check(payload)
+	if err != nil {
+		return Message{}, err
+	}
+
+	bp := bencodePex{}
+	err = bencode.Unmarshal(bytes.NewReader(payload), &bp)
+	if err != nil {
+		return Message{}, err
+	}
+
+	added, err := peers.UnmarshallPeers([]byte(bp.Added))
+	if err != nil {
+		return Message{}, err
+	}
+
+	dropped, err := peers.UnmarshallPeers([]byte(bp.Dropped))
+	if err != nil {
+		return Message{}, err
+	}
+
+	added6, err := peers.UnmarshallPeers6([]byte(bp.Added6))
+	if err != nil {
+		return Message{}, err
+	}
+
+	dropped6, err := peers.UnmarshallPeers6([]byte(bp.Dropped6))
+	if err != nil {
+		return Message{}, err
+	}
+
+	msg := Message{
+		Added:   withFlags(added, bp.AddedF),
+		Dropped: dropped[:min(len(dropped), MAX_PEERS)],
+	}
+	msg.Added = append(msg.Added, withFlags(added6, bp.Added6F)...)
+	msg.Dropped = append(msg.Dropped, dropped6[:min(len(dropped6), MAX_PEERS)]...)
+
+	return msg, nil
+}
+
+func withFlags(added []peers.Peer, flags string) []Peer {
+	list := make([]Peer, 0, min(len(added), MAX_PEERS))
+
+	for i, p := range added[:min(len(added), MAX_PEERS)] {
+		var f byte
+		if i < len(flags) {
+			f = flags[i]
+		}
+		list = append(list, Peer{Peer: p, Flags: f})
+	}
+
+	return list
+}
@@ -0,0 +1,111 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+/*
+NOTES
+- A token bucket in bytes: it fills up at the configured rate and holds at
+  most a second worth of tokens (never less than MIN_BURST, so a whole
+  block always fits)
+- Callers reserve what they need right away even if that drives the bucket
+  negative and then sleep until the debt is paid off. Whoever came first is
+  served first, which shares the bandwidth fairly between peers
+- A nil limiter or a rate of 0 means unlimited. Transfers go through the
+  global limiter and the torrent's own one, the stricter of the two wins
+*/
+
+const MIN_BURST = 32 * 1024
+
+var (
+	GlobalDownload = New(0)
+	GlobalUpload   = New(0)
+)
+
+type Limiter struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+// note: bytesPerSec of 0 means unlimited
+func New(bytesPerSec int) *Limiter {
+	l := Limiter{}
+	l.SetRate(bytesPerSec)
+	return &l
+}
+
+func (l *Limiter) SetRate(bytesPerSec int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.rate = float64(max(bytesPerSec, 0))
+	l.tokens = min(l.tokens, l.burst())
+	l.last = time.Now()
+}
+
+func (l *Limiter) Rate() int {
+	if l == nil {
+		return 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return int(l.rate)
+}
+
+func (l *Limiter) burst() float64 {
+	return max(l.rate, MIN_BURST)
+}
+
+// note: takes n tokens and returns how long to wait before using them
+func (l *Limiter) reserve(n int) time.Duration {
+	if l == nil {
+		return 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.rate == 0 {
+		return 0
+	}
+
+	now := time.Now()
+	l.tokens = min(l.tokens+now.Sub(l.last).Seconds()*l.rate, l.burst())
+	l.last = now
+
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+/*
+note: blocks until n bytes may go through every limiter, or until done is
+closed. the tokens are spent either way
+*/
+func Wait(done <-chan struct{}, n int, limiters ...*Limiter) {
+	var wait time.Duration
+	for _, l := range limiters {
+		wait = max(wait, l.reserve(n))
+	}
+
+	if wait == 0 {
+		return
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+	case <-done:
+	}
+}
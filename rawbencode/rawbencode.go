@@ -0,0 +1,137 @@
+package rawbencode
+
+import (
+	"fmt"
+	"strconv"
+)
+
+/*
+NOTES
+- Works on the encoded bytes directly instead of decoding into Go values,
+  for when the exact bytes of a value matter or when a bencoded value is
+  followed by raw data (ut_metadata pieces)
+*/
+
+/*
+note: how deep lists and dicts may nest. real torrents and messages stay
+far below it, anything deeper is someone trying to exhaust the stack
+*/
+const MAX_DEPTH = 64
+
+// note: returns the index just past the bencoded value that starts at buf[start]
+func ValueEnd(buf []byte, start int) (int, error) {
+	return valueEnd(buf, start, 0)
+}
+
+func valueEnd(buf []byte, start int, depth int) (int, error) {
+	if start >= len(buf) {
+		return 0, fmt.Errorf("unexpected end of data at [%d]", start)
+	}
+
+	switch c := buf[start]; {
+	case c == 'i':
+		for i := start + 1; i < len(buf); i++ {
+			if buf[i] == 'e' {
+				return i + 1, nil
+			}
+		}
+		return 0, fmt.Errorf("unterminated integer at [%d]", start)
+
+	case c == 'l' || c == 'd':
+		if depth >= MAX_DEPTH {
+			return 0, fmt.Errorf("nested deeper than %d at [%d]", MAX_DEPTH, start)
+		}
+
+		pos := start + 1
+		for pos < len(buf) && buf[pos] != 'e' {
+			end, err := valueEnd(buf, pos, depth+1)
+			if err != nil {
+				return 0, err
+			}
+			pos = end
+		}
+		if pos >= len(buf) {
+			return 0, fmt.Errorf("unterminated list or dict at [%d]", start)
+		}
+		return pos + 1, nil
+
+	case c >= '0' && c <= '9':
+		colon := start
+		for colon < len(buf) && buf[colon] != ':' {
+			colon++
+		}
+		if colon >= len(buf) {
+			return 0, fmt.Errorf("unterminated string length at [%d]", start)
+		}
+
+		length, err := strconv.Atoi(string(buf[start:colon]))
+		if err != nil {
+			return 0, err
+		}
+
+		// note: compared before adding, a huge length would overflow the sum
+		if length < 0 || length > len(buf)-colon-1 {
+			return 0, fmt.Errorf("string at [%d] runs past the end of data", start)
+		}
+		return colon + 1 + length, nil
+
+	default:
+		return 0, fmt.Errorf("unexpected byte %q at [%d]", c, start)
+	}
+}
+
+/*
+note: finds key in the dictionary that starts at buf[0] and returns where
+its value starts and ends, so the value's exact bytes are buf[start:end]
+*/
+func DictValue(buf []byte, key string) (int, int, error) {
+	if len(buf) == 0 || buf[0] != 'd' {
+		return 0, 0, fmt.Errorf("not a dictionary")
+	}
+
+	pos := 1
+	for pos < len(buf) && buf[pos] != 'e' {
+		keyEnd, err := ValueEnd(buf, pos)
+		if err != nil {
+			return 0, 0, err
+		}
+		if buf[pos] < '0' || buf[pos] > '9' {
+			return 0, 0, fmt.Errorf("dictionary key at [%d] is not a string", pos)
+		}
+
+		valueEnd, err := ValueEnd(buf, keyEnd)
+		if err != nil {
+			return 0, 0, err
+		}
+
+		colon := pos
+		for buf[colon] != ':' {
+			colon++
+		}
+		if string(buf[colon+1:keyEnd]) == key {
+			return keyEnd, valueEnd, nil
+		}
+
+		pos = valueEnd
+	}
+
+	return 0, 0, fmt.Errorf("dictionary has no %q key", key)
+}
+
+/*
+note: checks that buf is exactly one well formed value. jackpal/bencode-go
+believes whatever string length it reads and panics on absurd ones, so
+bencode from the network has to pass this before it's decoded
+*/
+func Check(buf []byte) error {
+	end, err := ValueEnd(buf, 0)
+	if err != nil {
+		return err
+	}
+
+	if end != len(buf) {
+		return fmt.Errorf("trailing data after the value at [%d]", end)
+	}
+
+	return nil
+}
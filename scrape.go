@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"torry/magnet"
+	"torry/torrentfile"
+	"torry/tracker"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+type scrapeMsg struct {
+	result *tracker.ScrapeResult
+	err    error
+}
+
+// note: how healthy the swarm is, asked for in the background when the TUI opens
+func scrapeSwarm(tf torrentfile.TorrentFile) tea.Cmd {
+	return func() tea.Msg {
+		res, err := tracker.NewList(tf.Announce, tf.AnnounceList).Scrape(tf.InfoHash)
+		return scrapeMsg{res, err}
+	}
+}
+
+func formatScrape(res *tracker.ScrapeResult) string {
+	return fmt.Sprintf("%d seeders, %d leechers, %d completed", res.Seeders, res.Leechers, res.Completed)
+}
+
+/*
+note: torry scrape <torrent | magnet>, asks every tracker of the torrent
+about its swarm without downloading anything. a magnet link only needs its
+infohash and trackers for this, no metadata is fetched
+*/
+func runScrape(args []string) {
+	if len(args) < 1 {
+		fmt.Println("Use: torry scrape path/to/some.torrent | 'magnet:?xt=urn:btih:...'")
+		os.Exit(1)
+	}
+
+	var infoHash [20]byte
+	var trackers []string
+
+	if strings.HasPrefix(args[0], "magnet:") {
+		m, err := magnet.Parse(args[0])
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		infoHash = m.InfoHash
+		trackers = m.Trackers
+	} else {
+		tf, err := torrentfile.OpenTorrentFile(args[0])
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		infoHash = tf.InfoHash
+		for _, tier := range tracker.NewList(tf.Announce, tf.AnnounceList).Tiers() {
+			trackers = append(trackers, tier...)
+		}
+	}
+
+	if len(trackers) == 0 {
+		fmt.Println("torrent has no trackers")
+		os.Exit(1)
+	}
+
+	fmt.Printf("%x\n", infoHash)
+	failed := 0
+	for _, announce := range trackers {
+		res, err := tracker.Scrape(announce, infoHash)
+		if err != nil {
+			fmt.Printf("  %s: %v\n", announce, err)
+			failed++
+			continue
+		}
+		fmt.Printf("  %s: %s\n", announce, formatScrape(res))
+	}
+
+	if failed == len(trackers) {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,151 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+/*
+NOTES
+- The files of a torrent are laid end to end in the piece space, so a file
+  occupies [offset, offset+length) where offset is the sum of the lengths of
+  the files before it
+- A read or write that straddles a file boundary is split across both files
+*/
+
+// note: Path is relative to the working directory, Length is in bytes
+type File struct {
+	Path   string
+	Length int
+}
+
+type Storage struct {
+	files   []File
+	handles []*os.File
+	offsets []int64
+	Length  int64
+}
+
+func Open(files []File) (*Storage, error) {
+	s := Storage{
+		files:   files,
+		handles: make([]*os.File, len(files)),
+		offsets: make([]int64, len(files)),
+	}
+
+	for i, f := range files {
+		s.offsets[i] = s.Length
+		s.Length += int64(f.Length)
+
+		err := os.MkdirAll(filepath.Dir(f.Path), 0755)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+
+		// note: no O_TRUNC, whatever is already on disk is kept around
+		handle, err := os.OpenFile(f.Path, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.handles[i] = handle
+	}
+
+	return &s, nil
+}
+
+/*
+note: calls fn once for every file that overlaps [off, off+n) with the
+file index, the offset inside that file and the slice of [0, n) it covers
+*/
+func (s *Storage) span(off int64, n int, fn func(i int, fileOff int64, begin, end int) error) error {
+	if off < 0 || off+int64(n) > s.Length {
+		return fmt.Errorf("range [%d, %d) is out of bounds for length [%d]", off, off+int64(n), s.Length)
+	}
+
+	done := 0
+	for i, f := range s.files {
+		if done == n {
+			break
+		}
+
+		fileEnd := s.offsets[i] + int64(f.Length)
+		pos := off + int64(done)
+		if pos >= fileEnd {
+			continue
+		}
+
+		chunk := int(min(fileEnd-pos, int64(n-done)))
+		err := fn(i, pos-s.offsets[i], done, done+chunk)
+		if err != nil {
+			return err
+		}
+		done += chunk
+	}
+
+	return nil
+}
+
+func (s *Storage) WriteAt(p []byte, off int64) (int, error) {
+	written := 0
+	err := s.span(off, len(p), func(i int, fileOff int64, begin, end int) error {
+		n, err := s.handles[i].WriteAt(p[begin:end], fileOff)
+		written += n
+		return err
+	})
+
+	return written, err
+}
+
+// note: reading past what has been written so far returns io.EOF
+func (s *Storage) ReadAt(p []byte, off int64) (int, error) {
+	read := 0
+	err := s.span(off, len(p), func(i int, fileOff int64, begin, end int) error {
+		n, err := s.handles[i].ReadAt(p[begin:end], fileOff)
+		read += n
+		if errors.Is(err, io.EOF) && n == end-begin {
+			return nil
+		}
+		return err
+	})
+
+	return read, err
+}
+
+func (s *Storage) Close() error {
+	var errs []error
+	for _, handle := range s.handles {
+		if handle != nil {
+			errs = append(errs, handle.Close())
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// note: a snapshot of a file on disk, used to tell if it changed between runs
+type FileState struct {
+	Length  int64
+	ModTime int64
+}
+
+func (s *Storage) Stat() ([]FileState, error) {
+	states := make([]FileState, len(s.handles))
+	for i, handle := range s.handles {
+		info, err := handle.Stat()
+		if err != nil {
+			return nil, err
+		}
+
+		states[i] = FileState{
+			Length:  info.Size(),
+			ModTime: info.ModTime().UnixNano(),
+		}
+	}
+
+	return states, nil
+}
@@ -0,0 +1,270 @@
+package torrentfile
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	bencode "github.com/jackpal/bencode-go"
+)
+
+/*
+NOTES
+- Create hashes a file, or every regular file below a directory, into a
+  .torrent. The files of a directory are laid out in the lexical order
+  WalkDir visits them in
+- The info dict is marshalled from the struct the parser decodes into,
+  with nothing in it the struct doesn't have. OpenTorrentFile hashes those
+  exact bytes again when the torrent is opened
+- Without a piece length one is picked so that the torrent ends up with
+  around TARGET_PIECES pieces
+*/
+
+const MIN_PIECE_LENGTH = 16 * 1024
+const MAX_PIECE_LENGTH = 16 * 1024 * 1024
+const TARGET_PIECES = 1500
+
+type CreateOptions struct {
+	// note: 0 picks one from the total size, otherwise a power of two of at least MIN_PIECE_LENGTH
+	PieceLength int
+
+	// note: every tier of AnnounceList is a list of trackers, Announce is the first of them
+	AnnounceList [][]string
+	Comment      string
+	CreatedBy    string
+	Private      bool
+
+	// note: HTTP URLs that serve the files too (BEP 19), they go in "url-list"
+	WebSeeds []string
+}
+
+/*
+note: what goes in a created torrent beside the info dict. it's kept apart
+from bencodeTorrent because url-list can be a plain string in the wild
+which would trip up parsing
+*/
+type bencodeCreatedTorrent struct {
+	Announce     string             `bencode:"announce,omitempty"`
+	AnnounceList [][]string         `bencode:"announce-list,omitempty"`
+	Comment      string             `bencode:"comment,omitempty"`
+	CreatedBy    string             `bencode:"created by,omitempty"`
+	CreationDate int64              `bencode:"creation date,omitempty"`
+	URLList      []string           `bencode:"url-list,omitempty"`
+	Info         bencodeTorrentInfo `bencode:"info"`
+}
+
+type sourceFile struct {
+	path     string
+	relative []string
+	length   int
+}
+
+// note: returns the bencoded torrent, ready to be written to a .torrent file
+func Create(root string, opts CreateOptions) ([]byte, error) {
+	// note: absolute so that "." is named after the directory it is
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+
+	name := filepath.Base(root)
+	if !validPathElement(name) {
+		return nil, fmt.Errorf("invalid torrent name %q", name)
+	}
+
+	files, err := collectFiles(root)
+	if err != nil {
+		return nil, err
+	}
+
+	total := 0
+	for _, f := range files {
+		total += f.length
+	}
+	if total == 0 {
+		return nil, fmt.Errorf("%s is empty, there is nothing to hash", root)
+	}
+
+	pieceLength := opts.PieceLength
+	if pieceLength == 0 {
+		pieceLength = choosePieceLength(total)
+	}
+	if pieceLength < MIN_PIECE_LENGTH || pieceLength&(pieceLength-1) != 0 {
+		return nil, fmt.Errorf("piece length %d is not a power of two of at least %d", pieceLength, MIN_PIECE_LENGTH)
+	}
+
+	pieces, err := hashPieces(files, pieceLength)
+	if err != nil {
+		return nil, err
+	}
+
+	info := bencodeTorrentInfo{
+		Pieces:      pieces,
+		PieceLength: pieceLength,
+		Name:        name,
+	}
+	if opts.Private {
+		info.Private = 1
+	}
+
+	// note: a single file keeps "length", a directory lists its files even if there is only one
+	stat, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	if stat.IsDir() {
+		for _, f := range files {
+			info.Files = append(info.Files, bencodeFile{Length: f.length, Path: f.relative})
+		}
+	} else {
+		info.Length = total
+	}
+
+	bt := bencodeCreatedTorrent{
+		Comment:      opts.Comment,
+		CreatedBy:    opts.CreatedBy,
+		CreationDate: time.Now().Unix(),
+		URLList:      opts.WebSeeds,
+		Info:         info,
+	}
+
+	tiers := [][]string{}
+	for _, tier := range opts.AnnounceList {
+		if len(tier) > 0 {
+			tiers = append(tiers, tier)
+		}
+	}
+	if len(tiers) > 0 {
+		bt.Announce = tiers[0][0]
+	}
+	// note: a single tracker doesn't need an announce-list, clients fall back to announce
+	if len(tiers) > 1 || (len(tiers) == 1 && len(tiers[0]) > 1) {
+		bt.AnnounceList = tiers
+	}
+
+	var buff bytes.Buffer
+	err = bencode.Marshal(&buff, bt)
+	if err != nil {
+		return nil, err
+	}
+
+	return buff.Bytes(), nil
+}
+
+func collectFiles(root string) ([]sourceFile, error) {
+	stat, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+
+	if !stat.IsDir() {
+		if !stat.Mode().IsRegular() {
+			return nil, fmt.Errorf("%s is not a regular file", root)
+		}
+		return []sourceFile{{path: root, length: int(stat.Size())}}, nil
+	}
+
+	files := []sourceFile{}
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+
+		files = append(files, sourceFile{
+			path:     path,
+			relative: strings.Split(filepath.ToSlash(rel), "/"),
+			length:   int(info.Size()),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(files) == 0 {
+		return nil, fmt.Errorf("%s has no files in it", root)
+	}
+
+	return files, nil
+}
+
+func choosePieceLength(total int) int {
+	pieceLength := MIN_PIECE_LENGTH
+	for pieceLength < MAX_PIECE_LENGTH && total/pieceLength > TARGET_PIECES {
+		pieceLength *= 2
+	}
+	return pieceLength
+}
+
+// note: the files are read back to back as one stream, pieces run across file boundaries
+func hashPieces(files []sourceFile, pieceLength int) (string, error) {
+	buf := make([]byte, 0, pieceLength)
+	var pieces bytes.Buffer
+
+	for _, f := range files {
+		n, err := hashFile(f, pieceLength, &buf, &pieces)
+		if err != nil {
+			return "", err
+		}
+		if n != f.length {
+			return "", fmt.Errorf("%s changed while it was hashed", f.path)
+		}
+	}
+
+	if len(buf) > 0 {
+		hash := sha1.Sum(buf)
+		pieces.Write(hash[:])
+	}
+
+	return pieces.String(), nil
+}
+
+// note: fills the piece buffer from the file, every time it's full its hash goes to pieces
+func hashFile(f sourceFile, pieceLength int, buf *[]byte, pieces *bytes.Buffer) (int, error) {
+	file, err := os.Open(f.path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	r := io.LimitReader(file, int64(f.length))
+	read := 0
+
+	for {
+		n, err := io.ReadFull(r, (*buf)[len(*buf):pieceLength])
+		*buf = (*buf)[:len(*buf)+n]
+		read += n
+
+		if len(*buf) == pieceLength {
+			hash := sha1.Sum(*buf)
+			pieces.Write(hash[:])
+			*buf = (*buf)[:0]
+		}
+
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return read, nil
+		}
+		if err != nil {
+			return read, err
+		}
+	}
+}
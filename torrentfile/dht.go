@@ -0,0 +1,86 @@
+package torrentfile
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+	"torry/dht"
+	"torry/downloader"
+	"torry/events"
+	"torry/peers"
+)
+
+const DHT_PORT = 6881
+const DHT_ANNOUNCE_INTERVAL = 15 * time.Minute
+
+var (
+	dhtOnce sync.Once
+	dhtMu   sync.Mutex
+	dhtNode *dht.DHT
+	dhtErr  error
+)
+
+/*
+note: one DHT node is shared by everything in the process. it's started and
+bootstrapped on first use, the bootstrap nodes of later torrents are ignored
+*/
+func startDHT(bootstrap []string) (*dht.DHT, error) {
+	dhtOnce.Do(func() {
+		node, err := dht.New(DHT_PORT, dht.DefaultTablePath())
+		if err != nil {
+			// note: the port is taken (probably by another torry), run a throwaway node
+			node, err = dht.New(0, "")
+		}
+		if err != nil {
+			dhtErr = err
+			return
+		}
+
+		err = node.Bootstrap(bootstrap)
+		if err != nil {
+			node.Close()
+			dhtErr = err
+			return
+		}
+
+		dhtMu.Lock()
+		dhtNode = node
+		dhtMu.Unlock()
+	})
+
+	dhtMu.Lock()
+	defer dhtMu.Unlock()
+	return dhtNode, dhtErr
+}
+
+func dhtPeers(infoHash [20]byte, bootstrap []string, port int) ([]peers.Peer, error) {
+	node, err := startDHT(bootstrap)
+	if err != nil {
+		return nil, err
+	}
+
+	return node.Announce(infoHash, port)
+}
+
+// note: keeps announcing to the DHT and hands whatever peers turn up to the download
+func (t *TorrentFile) discoverDHT(ctx context.Context, torrent *downloader.Torrent, port int) {
+	node, err := startDHT(t.Nodes)
+	if err != nil {
+		torrent.Events.Publish(events.Error{Err: fmt.Errorf("DHT unavailable: %w", err)})
+		return
+	}
+
+	for {
+		found, err := node.Announce(t.InfoHash, port)
+		if err == nil {
+			torrent.AddPeers(found)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(DHT_ANNOUNCE_INTERVAL):
+		}
+	}
+}
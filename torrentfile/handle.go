@@ -0,0 +1,227 @@
+package torrentfile
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"torry/downloader"
+	"torry/events"
+	"torry/listener"
+	"torry/peers"
+	"torry/ratelimit"
+	"torry/storage"
+	"torry/tracker"
+)
+
+/*
+NOTES
+- A Handle is a running torrent: the download (then seeding), its tracker
+  session, its place on the shared listener and the DHT/LSD discovery
+- Stop tears all of it down, the trackers hear "stopped" and the resume
+  file is saved. Every handle still running is stopped by Shutdown
+*/
+
+type Handle struct {
+	torrent  *downloader.Torrent
+	session  *tracker.Session
+	listener *listener.Listener
+	cancel   context.CancelFunc
+	finished chan struct{}
+	err      error
+}
+
+var (
+	handlesMu sync.Mutex
+	handles   = map[*Handle]bool{}
+)
+
+// note: sets everything up and starts downloading in the background, bus may be nil
+func (t *TorrentFile) Start(ctx context.Context, bus *events.Bus) (*Handle, error) {
+	peerID, err := newPeerID()
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]storage.File, len(t.Files))
+	for i, f := range t.Files {
+		files[i] = storage.File{
+			Path:   filepath.Join(f.Path...),
+			Length: f.Length,
+		}
+	}
+
+	torrent := downloader.Torrent{
+		PeerID:      peerID,
+		InfoHash:    t.InfoHash,
+		PieceHashes: t.PieceHashes,
+		PieceLength: t.PieceLength,
+		Length:      t.Length,
+		Name:        t.Name,
+		Files:       files,
+		Peers:       append([]peers.Peer(nil), t.Peers...),
+		ResumePath:  t.Name + ".torry",
+		Private:     t.Private,
+		Events:      bus,
+
+		DownloadLimit: ratelimit.New(0),
+		UploadLimit:   ratelimit.New(0),
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	h := Handle{
+		torrent:  &torrent,
+		cancel:   cancel,
+		finished: make(chan struct{}),
+	}
+
+	/*
+		note: if the port is taken we can still download, we just can't be
+		reached by other peers (so there's no point announcing on the LAN)
+	*/
+	port := uint16(LISTEN_PORT)
+	l, err := startListener()
+	if err == nil {
+		l.Register(t.InfoHash, &torrent)
+		port = l.Port()
+		h.listener = l
+	}
+
+	/*
+		note: with the trackers down we can still find peers through the DHT,
+		so the first announce runs alongside the download and its peers are
+		added when they come. private torrents must only use their trackers,
+		they don't start without them
+	*/
+	h.session = t.startSession(&torrent, peerID, port)
+	if t.Private {
+		_, err = h.session.Start()
+		if err != nil {
+			h.session.Stop()
+			if h.listener != nil {
+				h.listener.Unregister(t.InfoHash)
+			}
+			cancel()
+			return nil, err
+		}
+	} else {
+		go h.session.Start()
+	}
+
+	if !t.Private {
+		go t.discoverDHT(ctx, &torrent, int(port))
+
+		if h.listener != nil {
+			err = t.discoverLSD(ctx, &torrent, int(port))
+			if err != nil {
+				bus.Publish(events.Error{Err: fmt.Errorf("local service discovery unavailable: %w", err)})
+			}
+		}
+	}
+
+	handlesMu.Lock()
+	handles[&h] = true
+	handlesMu.Unlock()
+
+	// note: cancelling the parent context stops the handle just like Stop does
+	go func() {
+		<-ctx.Done()
+		h.session.Stop()
+		if h.listener != nil {
+			h.listener.Unregister(t.InfoHash)
+		}
+	}()
+
+	go func() {
+		defer close(h.finished)
+
+		h.err = torrent.Download(ctx)
+		if h.err != nil {
+			if ctx.Err() == nil {
+				bus.Publish(events.Error{Err: h.err})
+			}
+			return
+		}
+
+		// note: nothing downloaded means we started out as a seed, trackers only want to hear about real completions
+		_, downloaded, _ := torrent.Stats()
+		if downloaded > 0 {
+			h.session.Completed()
+		}
+	}()
+
+	return &h, nil
+}
+
+// note: returns once the download is complete (it keeps seeding) or failed or was stopped
+func (h *Handle) Wait() error {
+	<-h.finished
+	return h.err
+}
+
+func (h *Handle) Pause() error {
+	return h.torrent.Pause()
+}
+
+func (h *Handle) Resume() {
+	h.torrent.Resume()
+}
+
+func (h *Handle) Paused() bool {
+	return h.torrent.Paused()
+}
+
+// note: caps this torrent on top of the global limits, in bytes per second. 0 lifts the cap
+func (h *Handle) SetDownloadLimit(bytesPerSec int) {
+	h.torrent.DownloadLimit.SetRate(bytesPerSec)
+}
+
+func (h *Handle) SetUploadLimit(bytesPerSec int) {
+	h.torrent.UploadLimit.SetRate(bytesPerSec)
+}
+
+// note: how many peers this torrent may be connected to, 0 goes back to the default
+func (h *Handle) SetMaxConnections(max int) {
+	h.torrent.SetMaxConnections(max)
+}
+
+func (h *Handle) Stop() {
+	h.cancel()
+	h.session.Stop()
+	<-h.finished
+	<-h.torrent.Done()
+
+	handlesMu.Lock()
+	delete(handles, h)
+	handlesMu.Unlock()
+}
+
+/*
+note: called on the way out. stops every running torrent (the trackers get
+told), closes the listener and saves the DHT routing table for next time
+*/
+func Shutdown() {
+	handlesMu.Lock()
+	stopping := []*Handle{}
+	for h := range handles {
+		stopping = append(stopping, h)
+	}
+	handlesMu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, h := range stopping {
+		wg.Add(1)
+		go func(h *Handle) {
+			defer wg.Done()
+			h.Stop()
+		}(h)
+	}
+	wg.Wait()
+	closeListener()
+
+	dhtMu.Lock()
+	defer dhtMu.Unlock()
+	if dhtNode != nil {
+		dhtNode.Close()
+	}
+}
@@ -0,0 +1,55 @@
+package torrentfile
+
+import (
+	"sync"
+	"torry/client"
+	"torry/listener"
+)
+
+var (
+	listenerMu     sync.Mutex
+	sharedListener *listener.Listener
+)
+
+/*
+note: like the DHT node, one listener is shared by every torrent, they
+register their infohash with it. if the port can't be had the next torrent
+tries again
+*/
+func startListener() (*listener.Listener, error) {
+	listenerMu.Lock()
+	defer listenerMu.Unlock()
+
+	if sharedListener != nil {
+		return sharedListener, nil
+	}
+
+	l, err := listener.Listen(LISTEN_PORT)
+	if err != nil {
+		return nil, err
+	}
+
+	sharedListener = l
+	client.AdvertisedPort = int(l.Port())
+	return l, nil
+}
+
+// note: the port peers can reach us on, LISTEN_PORT if the listener couldn't be started
+func listenPort() int {
+	l, err := startListener()
+	if err != nil {
+		return LISTEN_PORT
+	}
+
+	return int(l.Port())
+}
+
+func closeListener() {
+	listenerMu.Lock()
+	defer listenerMu.Unlock()
+
+	if sharedListener != nil {
+		sharedListener.Close()
+		sharedListener = nil
+	}
+}
@@ -0,0 +1,43 @@
+package torrentfile
+
+import (
+	"context"
+	"sync"
+	"torry/downloader"
+	"torry/lsd"
+	"torry/peers"
+)
+
+var (
+	lsdOnce    sync.Once
+	lsdService *lsd.Service
+	lsdErr     error
+)
+
+// note: like the DHT node, one local service discovery socket is shared by every torrent
+func startLSD(port int) (*lsd.Service, error) {
+	lsdOnce.Do(func() {
+		lsdService, lsdErr = lsd.Start(port)
+	})
+
+	return lsdService, lsdErr
+}
+
+// note: LAN peers announcing the same infohash go straight to the download
+func (t *TorrentFile) discoverLSD(ctx context.Context, torrent *downloader.Torrent, port int) error {
+	service, err := startLSD(port)
+	if err != nil {
+		return err
+	}
+
+	service.Register(t.InfoHash, func(peer peers.Peer) {
+		torrent.AddPeers([]peers.Peer{peer})
+	})
+
+	go func() {
+		<-ctx.Done()
+		service.Unregister(t.InfoHash)
+	}()
+
+	return nil
+}
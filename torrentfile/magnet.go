@@ -0,0 +1,88 @@
+package torrentfile
+
+import (
+	"bytes"
+	"torry/magnet"
+	"torry/metadata"
+	"torry/tracker"
+
+	bencode "github.com/jackpal/bencode-go"
+)
+
+/*
+note: resolves a magnet link into a TorrentFile by asking the trackers (and
+any x.pe peers) for peers and fetching the info dictionary from them. the
+result goes down the same download path as a parsed .torrent file
+*/
+func OpenMagnet(uri string) (TorrentFile, error) {
+	m, err := magnet.Parse(uri)
+	if err != nil {
+		return TorrentFile{}, err
+	}
+
+	peerID, err := newPeerID()
+	if err != nil {
+		return TorrentFile{}, err
+	}
+
+	// note: every tr parameter is its own tier
+	announceList := make([][]string, len(m.Trackers))
+	for i, tr := range m.Trackers {
+		announceList[i] = []string{tr}
+	}
+
+	// note: the listener is started now so the port we announce is the one Start uses
+	port := listenPort()
+
+	candidates := m.Peers
+	if len(announceList) > 0 {
+		trackers := tracker.NewList("", announceList)
+
+		// note: the length isn't known yet, anything but 0 keeps us from looking like a seed
+		resp, err := trackers.Announce(tracker.Request{
+			InfoHash: m.InfoHash,
+			PeerID:   peerID,
+			Port:     uint16(port),
+			Left:     1,
+		})
+		if err == nil {
+			candidates = append(candidates, resp.Peers...)
+		}
+	}
+
+	// note: trackerless magnets (or dead trackers) fall back to the DHT
+	if len(candidates) == 0 {
+		found, err := dhtPeers(m.InfoHash, nil, port)
+		if err != nil {
+			return TorrentFile{}, err
+		}
+		candidates = found
+	}
+
+	info, err := metadata.FetchFromPeers(candidates, m.InfoHash, peerID)
+	if err != nil {
+		return TorrentFile{}, err
+	}
+
+	btfi := bencodeTorrentInfo{}
+	err = bencode.Unmarshal(bytes.NewReader(info), &btfi)
+	if err != nil {
+		return TorrentFile{}, err
+	}
+
+	// note: the infohash was already verified against the raw bytes we fetched
+	t, err := btfi.toTorrentFile(m.InfoHash)
+	if err != nil {
+		return TorrentFile{}, err
+	}
+
+	if len(m.Trackers) > 0 {
+		t.Announce = m.Trackers[0]
+	}
+	t.AnnounceList = announceList
+
+	// note: the peers that had the metadata most likely have the pieces as well
+	t.Peers = candidates
+
+	return t, nil
+}
@@ -0,0 +1,42 @@
+package torrentfile
+
+import (
+	"torry/downloader"
+	"torry/events"
+	"torry/tracker"
+)
+
+/*
+note: the tracker session of a download, it reports the torrent's counters,
+hands the peers it gets to the running download and publishes how every
+announce went
+*/
+func (t *TorrentFile) startSession(torrent *downloader.Torrent, peerID [20]byte, port uint16) *tracker.Session {
+	stats := func() tracker.Stats {
+		uploaded, downloaded, left := torrent.Stats()
+		return tracker.Stats{Uploaded: uploaded, Downloaded: downloaded, Left: left}
+	}
+
+	session := tracker.NewSession(
+		tracker.NewList(t.Announce, t.AnnounceList),
+		t.InfoHash,
+		peerID,
+		port,
+		stats,
+		func(resp *tracker.Response, err error) {
+			if err != nil {
+				torrent.Events.Publish(events.TrackerResponse{Err: err})
+				return
+			}
+
+			torrent.AddPeers(resp.Peers)
+			torrent.Events.Publish(events.TrackerResponse{
+				Interval: resp.Interval,
+				Peers:    len(resp.Peers),
+				Warning:  resp.Warning,
+			})
+		},
+	)
+
+	return session
+}
@@ -2,74 +2,217 @@ package torrentfile
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
 	"crypto/sha1"
 	"fmt"
-	"net/http"
-	"net/url"
+	"math"
+	"net"
 	"os"
 	"strconv"
-	"torry/downloader"
+	"strings"
+	"torry/events"
 	"torry/peers"
+	"torry/rawbencode"
 
 	bencode "github.com/jackpal/bencode-go"
 )
 
+const LISTEN_PORT = 6881
+
+type File struct {
+	Length int
+	Path   []string
+}
+
 type TorrentFile struct {
-	Announce    string
-	InfoHash    [20]byte
-	PieceHashes [][20]byte
-	PieceLength int
-	Length      int
-	Name        string
+	Announce     string
+	AnnounceList [][]string
+	InfoHash     [20]byte
+	PieceHashes  [][20]byte
+	PieceLength  int
+	Length       int
+	Name         string
+	Files        []File
+	Nodes        []string
+	Private      bool
+
+	// note: peers already known before the download starts, from a magnet link
+	Peers []peers.Peer
+}
+
+type bencodeFile struct {
+	Length int      `bencode:"length"`
+	Path   []string `bencode:"path"`
 }
 
+/*
+note: a single file torrent has a "length" key while a multi file torrent
+has a "files" list instead. both are omitempty so that a created torrent
+doesn't get a key it shouldn't have. keys that aren't modelled here are
+dropped when decoding, which is why the infohash is taken from the raw
+bytes of the info dict and never from this struct
+*/
 type bencodeTorrentInfo struct {
-	Pieces      string `bencode:"pieces"`
-	PieceLength int    `bencode:"piece length"`
-	Length      int    `bencode:"length"`
-	Name        string `bencode:"name"`
+	Pieces      string        `bencode:"pieces"`
+	PieceLength int           `bencode:"piece length"`
+	Length      int           `bencode:"length,omitempty"`
+	Files       []bencodeFile `bencode:"files,omitempty"`
+	Name        string        `bencode:"name"`
+	Private     int           `bencode:"private,omitempty"`
 }
 
 type bencodeTorrent struct {
-	Announce string             `bencode:"announce"`
-	Info     bencodeTorrentInfo `bencode:"info"`
+	Announce     string             `bencode:"announce"`
+	AnnounceList [][]string         `bencode:"announce-list"`
+	Nodes        [][]interface{}    `bencode:"nodes,omitempty"`
+	Info         bencodeTorrentInfo `bencode:"info"`
+}
+
+func (btfo *bencodeTorrent) toProcessedTorrentFile(infoHash [20]byte) (TorrentFile, error) {
+	t, err := btfo.Info.toTorrentFile(infoHash)
+	if err != nil {
+		return TorrentFile{}, err
+	}
+
+	t.Announce = btfo.Announce
+	t.AnnounceList = btfo.AnnounceList
+	t.Nodes = btfo.splitNodes()
+
+	return t, nil
+}
+
+// note: "nodes" is a list of [host, port] pairs for bootstrapping the DHT, malformed entries are skipped
+func (btfo *bencodeTorrent) splitNodes() []string {
+	nodes := []string{}
+
+	for _, pair := range btfo.Nodes {
+		if len(pair) != 2 {
+			continue
+		}
+
+		host, ok := pair[0].(string)
+		if !ok || host == "" {
+			continue
+		}
+
+		var port int64
+		switch p := pair[1].(type) {
+		case int64:
+			port = p
+		case int:
+			port = int64(p)
+		default:
+			continue
+		}
+		if port <= 0 || port > 65535 {
+			continue
+		}
+
+		nodes = append(nodes, net.JoinHostPort(host, strconv.FormatInt(port, 10)))
+	}
+
+	return nodes
 }
 
-func (btfo *bencodeTorrent) toProcessedTorrentFile() (TorrentFile, error) {
-	infoHash, err := btfo.Info.hash()
+func (btfi *bencodeTorrentInfo) toTorrentFile(infoHash [20]byte) (TorrentFile, error) {
+	if btfi.PieceLength <= 0 {
+		return TorrentFile{}, fmt.Errorf("invalid piece length %d", btfi.PieceLength)
+	}
+
+	pieceHashes, err := btfi.splitPieceHashes()
 	if err != nil {
 		return TorrentFile{}, err
 	}
 
-	pieceHashes, err := btfo.Info.splitPieceHashes()
+	files, length, err := btfi.splitFiles()
 	if err != nil {
 		return TorrentFile{}, err
 	}
 
+	// note: the downloader sizes every piece from these, they have to agree
+	pieces := length / btfi.PieceLength
+	if length%btfi.PieceLength != 0 {
+		pieces++
+	}
+	if len(pieceHashes) != pieces {
+		return TorrentFile{}, fmt.Errorf("expected %d piece hashes for %d bytes but got %d", pieces, length, len(pieceHashes))
+	}
+
 	t := TorrentFile{
-		Announce:    btfo.Announce,
 		InfoHash:    infoHash,
 		PieceHashes: pieceHashes,
-		PieceLength: btfo.Info.PieceLength,
-		Length:      btfo.Info.Length,
-		Name:        btfo.Info.Name,
+		PieceLength: btfi.PieceLength,
+		Length:      length,
+		Name:        btfi.Name,
+		Files:       files,
+		Private:     btfi.Private == 1,
 	}
 
 	return t, nil
 }
 
-func (btfi *bencodeTorrentInfo) hash() ([20]byte, error) {
-	var buff bytes.Buffer
+func validPathElement(elem string) bool {
+	if elem == "" || elem == "." || elem == ".." {
+		return false
+	}
 
-	err := bencode.Marshal(&buff, *btfi)
-	if err != nil {
-		fmt.Println("Error marshalling torrent info into buffer", err)
+	return !strings.ContainsAny(elem, "/\\")
+}
+
+func (btfi *bencodeTorrentInfo) splitFiles() ([]File, int, error) {
+	if !validPathElement(btfi.Name) {
+		return nil, 0, fmt.Errorf("invalid torrent name %q", btfi.Name)
+	}
+
+	// note: a single file torrent is treated as a one element file list
+	if len(btfi.Files) == 0 {
+		if btfi.Length < 0 {
+			return nil, 0, fmt.Errorf("negative length %d", btfi.Length)
+		}
+		return []File{{Length: btfi.Length, Path: []string{btfi.Name}}}, btfi.Length, nil
+	}
+
+	files := make([]File, len(btfi.Files))
+	length := 0
+
+	for i, f := range btfi.Files {
+		if len(f.Path) == 0 {
+			return nil, 0, fmt.Errorf("file #%d has an empty path", i)
+		}
+
+		for _, elem := range f.Path {
+			if !validPathElement(elem) {
+				return nil, 0, fmt.Errorf("file #%d has invalid path element %q", i, elem)
+			}
+		}
+
+		if f.Length < 0 {
+			return nil, 0, fmt.Errorf("file #%d has negative length %d", i, f.Length)
+		}
+		if f.Length > math.MaxInt-length {
+			return nil, 0, fmt.Errorf("file #%d overflows the torrent length", i)
+		}
+
+		// note: files of a multi file torrent live in a directory named after the torrent
+		files[i] = File{
+			Length: f.Length,
+			Path:   append([]string{btfi.Name}, f.Path...),
+		}
+		length += f.Length
 	}
 
-	infohash := sha1.Sum(buff.Bytes())
+	return files, length, nil
+}
 
-	return infohash, nil
+// note: the infohash is the SHA-1 of the info dict exactly as it is in the file
+func infoHash(raw []byte) ([20]byte, error) {
+	start, end, err := rawbencode.DictValue(raw, "info")
+	if err != nil {
+		return [20]byte{}, err
+	}
+
+	return sha1.Sum(raw[start:end]), nil
 }
 
 func (btfi *bencodeTorrentInfo) splitPieceHashes() ([][20]byte, error) {
@@ -100,127 +243,47 @@ func (btfi *bencodeTorrentInfo) splitPieceHashes() ([][20]byte, error) {
 
 func OpenTorrentFile(filePath string) (TorrentFile, error) {
 
-	file, err := os.Open(filePath)
+	raw, err := os.ReadFile(filePath)
 
 	if err != nil {
-		fmt.Println("Error opening torrent file", err)
+		return TorrentFile{}, err
 	}
 
-	defer file.Close()
-
 	bt := bencodeTorrent{}
 
 	/*
 		note: we are parsing the content of the torrent file and
 		storing it's values in an struct/object (bencodeTorrent)
 	*/
-	err = bencode.Unmarshal(file, &bt)
+	err = bencode.Unmarshal(bytes.NewReader(raw), &bt)
 
 	if err != nil {
-		fmt.Println("Error Unmarshalling:", err)
+		return TorrentFile{}, fmt.Errorf("parsing %s: %w", filePath, err)
 	}
 
-	return bt.toProcessedTorrentFile()
-}
-
-func (tf *TorrentFile) BuildTrackerURL(peerID [20]byte, port uint16) (string, error) {
-	base, err := url.Parse(tf.Announce)
-
+	hash, err := infoHash(raw)
 	if err != nil {
-		fmt.Println("Error Parsing URL:", err)
+		return TorrentFile{}, fmt.Errorf("parsing %s: %w", filePath, err)
 	}
 
-	params := url.Values{
-		"info_hash":  []string{string(tf.InfoHash[:])},
-		"peer_id":    []string{string(peerID[:])},
-		"port":       []string{strconv.Itoa(int(port))},
-		"uploaded":   []string{"0"},
-		"downloaded": []string{"0"},
-		"compact":    []string{"1"},
-		"left":       []string{strconv.Itoa(int(tf.Length))},
-	}
-
-	base.RawQuery = params.Encode()
-
-	return base.String(), nil
+	return bt.toProcessedTorrentFile(hash)
 }
 
-func (t *TorrentFile) getPeers(peerID [20]byte, port uint16) ([]peers.Peer, error) {
-	trackerURL, err := t.BuildTrackerURL(peerID, port)
-	/* note
-	This is what the URL looks like after encoding the params
-		http://bttracker.debian.org:6969/announce?compact=1&downloaded=0&info
-		_hash=%A5%94%DF%3A%B9%B4%D3%95b%CC%05%F91%98i%A2%18%12%1FG&left=67842
-		8672&peer_id=e%F5_GM%B3hRJ~%A69%04%EC%9Ft%98%B3%14%24&port=2131&uploa
-		ded=0
-	*/
-	if err != nil {
-		fmt.Println(err)
-	}
-
-	resp, err := http.Get(trackerURL)
-
-	if err != nil {
-		fmt.Println("Error sending request to tracker URL", err)
-	}
-
-	defer resp.Body.Close()
-
-	trackerResponse := peers.TrackerURLResponse{}
-
-	err = bencode.Unmarshal(resp.Body, &trackerResponse)
-
-	if err != nil {
-		fmt.Println("Error parsing tracker response", err)
-	}
-
-	/*
-		note: casting the bencoded peers binary string to a slice of bytes for
-		processing/unmarshalling
-	*/
-	peers, err := peers.UnmarshallPeers([]byte(trackerResponse.Peers))
-	if err != nil {
-		return nil, err
-	}
-
-	return peers, nil
-}
-
-func (t *TorrentFile) D2f(progressChan *chan float64, buffChan *chan []byte) error {
+func newPeerID() ([20]byte, error) {
 	var peerID [20]byte
 	_, err := rand.Read(peerID[:])
-	if err != nil {
-		return err
-	}
-
-	peers, err := t.getPeers(peerID, 6881)
-	if err != nil {
-		return err
-	}
-
-	torrent := downloader.Torrent{
-		Peers:       peers,
-		PeerID:      peerID,
-		InfoHash:    t.InfoHash,
-		PieceHashes: t.PieceHashes,
-		PieceLength: t.PieceLength,
-		Length:      t.Length,
-		Name:        t.Name,
-	}
+	return peerID, err
+}
 
-	buf, err := torrent.Download(progressChan, buffChan)
+/*
+note: downloads the torrent and returns once it's complete (or ctx is
+cancelled), it keeps seeding until then. progress goes out on bus
+*/
+func (t *TorrentFile) D2f(ctx context.Context, bus *events.Bus) error {
+	h, err := t.Start(ctx, bus)
 	if err != nil {
 		return err
 	}
 
-	outFile, err := os.Create(torrent.Name)
-	if err != nil {
-		return err
-	}
-	defer outFile.Close()
-	_, err = outFile.Write(buf)
-	if err != nil {
-		return err
-	}
-	return nil
+	return h.Wait()
 }
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"torry/tracker"
+)
+
+/*
+note: torry tracker [-addr :6969] [-whitelist file], runs an HTTP tracker
+until killed. the whitelist file has one hex infohash per line, blank lines
+and lines starting with # are skipped
+*/
+func runTracker(args []string) {
+	fs := flag.NewFlagSet("tracker", flag.ExitOnError)
+	addr := fs.String("addr", ":6969", "address to serve announce and scrape on")
+	whitelistPath := fs.String("whitelist", "", "file of hex infohashes to track, all torrents if empty")
+	fs.Parse(args)
+
+	var whitelist [][20]byte
+	if *whitelistPath != "" {
+		var err error
+		whitelist, err = readWhitelist(*whitelistPath)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		// note: most likely a mistake, better to say so than to run a tracker that tracks nothing
+		if len(whitelist) == 0 {
+			fmt.Printf("%s lists no infohashes\n", *whitelistPath)
+			os.Exit(1)
+		}
+	}
+
+	ln, err := net.Listen("tcp", *addr)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Tracking on http://%s/announce\n", ln.Addr())
+	if whitelist != nil {
+		fmt.Printf("Whitelist: %d torrents\n", len(whitelist))
+	}
+
+	err = tracker.NewServer(whitelist).Serve(ln)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
+func readWhitelist(path string) ([][20]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	list := [][20]byte{}
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		b, err := hex.DecodeString(line)
+		if err != nil || len(b) != 20 {
+			return nil, fmt.Errorf("%s:%d: %q is not a hex infohash", path, n, line)
+		}
+
+		var ih [20]byte
+		copy(ih[:], b)
+		list = append(list, ih)
+	}
+
+	return list, scanner.Err()
+}
@@ -0,0 +1,171 @@
+package tracker
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+	"torry/peers"
+	"torry/rawbencode"
+
+	bencode "github.com/jackpal/bencode-go"
+)
+
+func buildURL(base *url.URL, req Request) string {
+	params := url.Values{
+		"info_hash":  []string{string(req.InfoHash[:])},
+		"peer_id":    []string{string(req.PeerID[:])},
+		"port":       []string{strconv.Itoa(int(req.Port))},
+		"uploaded":   []string{strconv.Itoa(req.Uploaded)},
+		"downloaded": []string{strconv.Itoa(req.Downloaded)},
+		"compact":    []string{"1"},
+		"left":       []string{strconv.Itoa(req.Left)},
+	}
+	if req.Event != EventNone {
+		params.Set("event", req.Event.String())
+	}
+	if req.IPv6 != nil {
+		params.Set("ipv6", req.IPv6.String())
+	}
+
+	// note: private trackers put a passkey in the query, so keep whatever is there
+	u := *base
+	if u.RawQuery != "" {
+		u.RawQuery += "&" + params.Encode()
+	} else {
+		u.RawQuery = params.Encode()
+	}
+
+	/* note
+	This is what the URL looks like after encoding the params
+		http://bttracker.debian.org:6969/announce?compact=1&downloaded=0&info
+		_hash=%A5%94%DF%3A%B9%B4%D3%95b%CC%05%F91%98i%A2%18%12%1FG&left=67842
+		8672&peer_id=e%F5_GM%B3hRJ~%A69%04%EC%9Ft%98%B3%14%24&port=2131&uploa
+		ded=0
+	*/
+	return u.String()
+}
+
+func announceHTTP(base *url.URL, req Request) (*Response, error) {
+	c := &http.Client{Timeout: 15 * time.Second}
+	resp, err := c.Get(buildURL(base, req))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	dict, err := readDict(base.Host, resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseHTTPResponse(base.Host, dict)
+}
+
+// note: no honest tracker answer comes anywhere near this
+const MAX_RESPONSE_SIZE = 1 << 20
+
+/*
+note: reads a bencoded dictionary from a tracker. like anything else from
+the network it is checked with rawbencode before it's decoded
+*/
+func readDict(tracker string, body io.Reader) (map[string]interface{}, error) {
+	raw, err := io.ReadAll(io.LimitReader(body, MAX_RESPONSE_SIZE+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) > MAX_RESPONSE_SIZE {
+		return nil, fmt.Errorf("tracker %s: response is over %d bytes", tracker, MAX_RESPONSE_SIZE)
+	}
+
+	err = rawbencode.Check(raw)
+	if err != nil {
+		return nil, fmt.Errorf("tracker %s: %w", tracker, err)
+	}
+
+	decoded, err := bencode.Decode(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+
+	dict, ok := decoded.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("tracker %s: response is not a dictionary", tracker)
+	}
+
+	return dict, nil
+}
+
+/*
+note: trackers are supposed to answer compact=1 with "peers" as one string
+of 6 byte entries, but some ignore it and send a list of dictionaries with
+"ip", "port" and "peer id" instead. both are taken
+*/
+func parseHTTPResponse(tracker string, dict map[string]interface{}) (*Response, error) {
+	if reason, ok := dict["failure reason"].(string); ok {
+		return nil, &FailureError{Tracker: tracker, Reason: reason}
+	}
+
+	interval, _ := dict["interval"].(int64)
+	minInterval, _ := dict["min interval"].(int64)
+	warning, _ := dict["warning message"].(string)
+
+	var peerList []peers.Peer
+	var err error
+
+	switch p := dict["peers"].(type) {
+	case string:
+		peerList, err = peers.UnmarshallPeers([]byte(p))
+	case []interface{}:
+		peerList, err = parsePeerDicts(p)
+	case nil:
+	default:
+		err = fmt.Errorf("tracker %s: unexpected peers of type %T", tracker, p)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if p6, ok := dict["peers6"].(string); ok {
+		peerList6, err := peers.UnmarshallPeers6([]byte(p6))
+		if err != nil {
+			return nil, err
+		}
+		peerList = append(peerList, peerList6...)
+	}
+
+	return &Response{
+		Interval:    int(interval),
+		MinInterval: int(minInterval),
+		Peers:       peerList,
+		Warning:     warning,
+	}, nil
+}
+
+// note: entries without a usable ip (trackers may send hostnames) or port are skipped
+func parsePeerDicts(list []interface{}) ([]peers.Peer, error) {
+	peerList := []peers.Peer{}
+
+	for _, item := range list {
+		entry, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("expected a peer dictionary but got %T", item)
+		}
+
+		host, _ := entry["ip"].(string)
+		port, _ := entry["port"].(int64)
+
+		ip := net.ParseIP(host)
+		if ip == nil || port <= 0 || port > 65535 {
+			continue
+		}
+
+		peerList = append(peerList, peers.Peer{IP: ip, Port: uint16(port)})
+	}
+
+	return peerList, nil
+}
@@ -0,0 +1,148 @@
+package tracker
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+/*
+NOTES
+- BEP 12 groups trackers into tiers. Trackers in a tier are shuffled once and
+  then tried in order until one responds, that one is moved to the front of
+  its tier so it gets asked first next time
+- Tiers are walked in order and the first tracker that answers is the one
+  used, later tiers are only asked when every tracker before them failed.
+  A dead UDP tracker is retried for minutes, so each tracker gets at most
+  ANNOUNCE_TIMEOUT before the next one is tried. Its late answer is dropped
+*/
+
+const ANNOUNCE_TIMEOUT = 20 * time.Second
+
+type List struct {
+	mu    sync.Mutex
+	tiers [][]string
+}
+
+func NewList(announce string, announceList [][]string) *List {
+	tiers := [][]string{}
+	for _, tier := range announceList {
+		urls := []string{}
+		for _, u := range tier {
+			if u != "" {
+				urls = append(urls, u)
+			}
+		}
+		if len(urls) == 0 {
+			continue
+		}
+
+		rand.Shuffle(len(urls), func(i, j int) {
+			urls[i], urls[j] = urls[j], urls[i]
+		})
+		tiers = append(tiers, urls)
+	}
+
+	// note: the announce key is only used when there is no announce-list
+	if len(tiers) == 0 && announce != "" {
+		tiers = append(tiers, []string{announce})
+	}
+
+	return &List{tiers: tiers}
+}
+
+func (l *List) Tiers() [][]string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	tiers := make([][]string, len(l.tiers))
+	for i, tier := range l.tiers {
+		tiers[i] = append([]string{}, tier...)
+	}
+	return tiers
+}
+
+func (l *List) promote(tier int, announce string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	urls := l.tiers[tier]
+	for i, u := range urls {
+		if u == announce {
+			copy(urls[1:i+1], urls[:i])
+			urls[0] = announce
+			return
+		}
+	}
+}
+
+// note: gives up on the tracker after ANNOUNCE_TIMEOUT, the announce itself carries on in the background
+func announceWithin(announce string, req Request) (*Response, error) {
+	type result struct {
+		resp *Response
+		err  error
+	}
+
+	done := make(chan result, 1)
+	go func() {
+		resp, err := Announce(announce, req)
+		done <- result{resp, err}
+	}()
+
+	select {
+	case res := <-done:
+		return res.resp, res.err
+	case <-time.After(ANNOUNCE_TIMEOUT):
+		return nil, fmt.Errorf("%s didn't answer in time", announce)
+	}
+}
+
+func (l *List) Announce(req Request) (*Response, error) {
+	tiers := l.Tiers()
+	if len(tiers) == 0 {
+		return nil, errors.New("torrent has no trackers")
+	}
+
+	var errs []error
+	for tier, urls := range tiers {
+		for _, announce := range urls {
+			resp, err := announceWithin(announce, req)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+
+			l.promote(tier, announce)
+			return resp, nil
+		}
+	}
+
+	return nil, errors.Join(errs...)
+}
+
+/*
+note: scrapes the trackers tier by tier and returns the first answer, the
+trackers of one torrent mostly see the same swarm
+*/
+func (l *List) Scrape(infoHash [20]byte) (*ScrapeResult, error) {
+	tiers := l.Tiers()
+	if len(tiers) == 0 {
+		return nil, errors.New("torrent has no trackers")
+	}
+
+	var errs []error
+	for _, urls := range tiers {
+		for _, announce := range urls {
+			res, err := Scrape(announce, infoHash)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			return res, nil
+		}
+	}
+
+	return nil, errors.Join(errs...)
+}
@@ -0,0 +1,140 @@
+package tracker
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+/*
+NOTES
+- A scrape (BEP 48) asks a tracker how big a swarm is without joining it:
+  how many seeders and leechers it knows of and how many downloads
+  completed
+- The HTTP scrape URL comes from the announce URL, the last path element
+  has to start with "announce" and that part is swapped for "scrape". A
+  tracker whose URL doesn't look like that can't be scraped
+- UDP trackers use the scrape action with the same connection ID
+*/
+
+type ScrapeResult struct {
+	Seeders   int
+	Leechers  int
+	Completed int
+}
+
+var ErrScrapeUnsupported = errors.New("tracker does not support scraping")
+
+func Scrape(announce string, infoHash [20]byte) (*ScrapeResult, error) {
+	base, err := url.Parse(announce)
+	if err != nil {
+		return nil, err
+	}
+
+	switch base.Scheme {
+	case "http", "https":
+		return scrapeHTTP(base, infoHash)
+	case "udp":
+		return scrapeUDP(base, infoHash)
+	default:
+		return nil, fmt.Errorf("unsupported tracker scheme %q", base.Scheme)
+	}
+}
+
+// note: http://tracker/x/announce?passkey=1 becomes http://tracker/x/scrape?passkey=1
+func ScrapeURL(base *url.URL) (*url.URL, error) {
+	i := strings.LastIndex(base.Path, "/")
+	if i < 0 || !strings.HasPrefix(base.Path[i+1:], "announce") {
+		return nil, ErrScrapeUnsupported
+	}
+
+	u := *base
+	u.Path = base.Path[:i+1] + "scrape" + strings.TrimPrefix(base.Path[i+1:], "announce")
+	u.RawPath = ""
+	return &u, nil
+}
+
+func scrapeHTTP(base *url.URL, infoHash [20]byte) (*ScrapeResult, error) {
+	u, err := ScrapeURL(base)
+	if err != nil {
+		return nil, err
+	}
+
+	params := url.Values{"info_hash": []string{string(infoHash[:])}}
+	if u.RawQuery != "" {
+		u.RawQuery += "&" + params.Encode()
+	} else {
+		u.RawQuery = params.Encode()
+	}
+
+	c := &http.Client{Timeout: 15 * time.Second}
+	resp, err := c.Get(u.String())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	dict, err := readDict(base.Host, resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if reason, ok := dict["failure reason"].(string); ok {
+		return nil, &FailureError{Tracker: base.Host, Reason: reason}
+	}
+
+	// note: "files" is keyed by the raw 20 byte infohash
+	files, _ := dict["files"].(map[string]interface{})
+	stats, ok := files[string(infoHash[:])].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("tracker %s doesn't know torrent %x", base.Host, infoHash)
+	}
+
+	complete, _ := stats["complete"].(int64)
+	incomplete, _ := stats["incomplete"].(int64)
+	downloaded, _ := stats["downloaded"].(int64)
+
+	return &ScrapeResult{
+		Seeders:   int(complete),
+		Leechers:  int(incomplete),
+		Completed: int(downloaded),
+	}, nil
+}
+
+func scrapeUDP(base *url.URL, infoHash [20]byte) (*ScrapeResult, error) {
+	ut, err := dialUDP(base)
+	if err != nil {
+		return nil, err
+	}
+	defer ut.conn.Close()
+
+	build := func(cid uint64, transactionID uint32) []byte {
+		// <connection_id 8><action 4><transaction_id 4><info_hash 20 * n>
+		packet := make([]byte, 36)
+		binary.BigEndian.PutUint64(packet[0:8], cid)
+		binary.BigEndian.PutUint32(packet[8:12], actionScrape)
+		binary.BigEndian.PutUint32(packet[12:16], transactionID)
+		copy(packet[16:36], infoHash[:])
+		return packet
+	}
+
+	res, err := ut.request(build, actionScrape)
+	if err != nil {
+		return nil, err
+	}
+
+	// <action 4><transaction_id 4><seeders 4><completed 4><leechers 4> per infohash
+	if len(res) < 20 {
+		return nil, fmt.Errorf("scrape response is too short: [%d]", len(res))
+	}
+
+	return &ScrapeResult{
+		Seeders:   int(binary.BigEndian.Uint32(res[8:12])),
+		Completed: int(binary.BigEndian.Uint32(res[12:16])),
+		Leechers:  int(binary.BigEndian.Uint32(res[16:20])),
+	}, nil
+}
@@ -0,0 +1,365 @@
+package tracker
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+	"torry/peers"
+
+	bencode "github.com/jackpal/bencode-go"
+)
+
+/*
+NOTES
+- A small HTTP tracker for private or local swarms: /announce and /scrape
+  as in BEP 3 and BEP 48. Swarms only live in memory
+- Peers are known by their peer id. A peer reaching us over IPv4 can tell
+  us its IPv6 address with ipv6= (BEP 7) and the other way around, it's
+  handed out under both
+- Compact answers put IPv4 peers in "peers" and IPv6 peers in "peers6",
+  the old answer is a list of dictionaries with both kinds in it
+- A peer that didn't announce for PEER_EXPIRY is dropped from its swarm
+- With a whitelist only the listed infohashes are tracked, everything else
+  gets a failure reason
+*/
+
+const SERVER_INTERVAL = 30 * time.Minute
+const SERVER_MIN_INTERVAL = time.Minute
+const PEER_EXPIRY = SERVER_INTERVAL + SERVER_INTERVAL/2
+const SWEEP_INTERVAL = time.Minute
+const DEFAULT_NUMWANT = 50
+const MAX_NUMWANT = 200
+
+type swarmPeer struct {
+	peerID   [20]byte
+	ip4      net.IP
+	ip6      net.IP
+	port     uint16
+	left     int
+	lastSeen time.Time
+}
+
+func (sp *swarmPeer) seed() bool {
+	return sp.left == 0
+}
+
+type swarm struct {
+	peers     map[[20]byte]*swarmPeer
+	completed int
+}
+
+func (sw *swarm) counts() (seeders int, leechers int) {
+	for _, sp := range sw.peers {
+		if sp.seed() {
+			seeders++
+		} else {
+			leechers++
+		}
+	}
+	return seeders, leechers
+}
+
+type Server struct {
+	mu        sync.Mutex
+	swarms    map[[20]byte]*swarm
+	whitelist map[[20]byte]bool
+	stop      chan struct{}
+	stopOnce  sync.Once
+}
+
+// note: a nil whitelist tracks any torrent, an empty one tracks none
+func NewServer(whitelist [][20]byte) *Server {
+	s := Server{
+		swarms: map[[20]byte]*swarm{},
+		stop:   make(chan struct{}),
+	}
+
+	if whitelist != nil {
+		s.whitelist = map[[20]byte]bool{}
+		for _, ih := range whitelist {
+			s.whitelist[ih] = true
+		}
+	}
+
+	return &s
+}
+
+// note: serves until the listener fails or Close is called
+func (s *Server) Serve(ln net.Listener) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/announce", s.handleAnnounce)
+	mux.HandleFunc("/scrape", s.handleScrape)
+
+	go s.sweep()
+
+	srv := http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-s.stop
+		srv.Close()
+	}()
+
+	err := srv.Serve(ln)
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+func (s *Server) Close() {
+	s.stopOnce.Do(func() { close(s.stop) })
+}
+
+func (s *Server) sweep() {
+	ticker := time.NewTicker(SWEEP_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+		}
+
+		s.mu.Lock()
+		for ih, sw := range s.swarms {
+			for id, sp := range sw.peers {
+				if time.Since(sp.lastSeen) > PEER_EXPIRY {
+					delete(sw.peers, id)
+				}
+			}
+			if len(sw.peers) == 0 && sw.completed == 0 {
+				delete(s.swarms, ih)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// note: trackers answer errors with a 200 and a failure reason, that's what clients look for
+func writeBencode(w http.ResponseWriter, v interface{}) {
+	var buff bytes.Buffer
+	err := bencode.Marshal(&buff, v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write(buff.Bytes())
+}
+
+func writeFailure(w http.ResponseWriter, reason string) {
+	writeBencode(w, map[string]interface{}{"failure reason": reason})
+}
+
+func (s *Server) tracked(infoHash [20]byte) bool {
+	return s.whitelist == nil || s.whitelist[infoHash]
+}
+
+func parseEvent(event string) Event {
+	switch event {
+	case "started":
+		return EventStarted
+	case "completed":
+		return EventCompleted
+	case "stopped":
+		return EventStopped
+	default:
+		return EventNone
+	}
+}
+
+func (s *Server) handleAnnounce(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	infoHash := q.Get("info_hash")
+	peerID := q.Get("peer_id")
+	if len(infoHash) != 20 || len(peerID) != 20 {
+		writeFailure(w, "invalid info_hash or peer_id")
+		return
+	}
+
+	port, err := strconv.ParseUint(q.Get("port"), 10, 16)
+	if err != nil || port == 0 {
+		writeFailure(w, "invalid port")
+		return
+	}
+
+	left, err := strconv.Atoi(q.Get("left"))
+	if err != nil || left < 0 {
+		writeFailure(w, "invalid left")
+		return
+	}
+
+	var ih [20]byte
+	copy(ih[:], infoHash)
+	if !s.tracked(ih) {
+		writeFailure(w, "torrent not registered with this tracker")
+		return
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	remote := net.ParseIP(host)
+	if err != nil || remote == nil {
+		writeFailure(w, "can't tell your address")
+		return
+	}
+
+	sp := swarmPeer{
+		port:     uint16(port),
+		left:     left,
+		lastSeen: time.Now(),
+	}
+	copy(sp.peerID[:], peerID)
+
+	if ip4 := remote.To4(); ip4 != nil {
+		sp.ip4 = ip4
+		if ip6 := net.ParseIP(q.Get("ipv6")); ip6 != nil && ip6.To4() == nil {
+			sp.ip6 = ip6
+		}
+	} else {
+		sp.ip6 = remote
+		if ip4 := net.ParseIP(q.Get("ipv4")).To4(); ip4 != nil {
+			sp.ip4 = ip4
+		}
+	}
+
+	numWant := DEFAULT_NUMWANT
+	if n, err := strconv.Atoi(q.Get("numwant")); err == nil && n >= 0 {
+		numWant = min(n, MAX_NUMWANT)
+	}
+
+	list, seeders, leechers := s.announce(ih, &sp, parseEvent(q.Get("event")), numWant)
+
+	resp := map[string]interface{}{
+		"interval":     int(SERVER_INTERVAL / time.Second),
+		"min interval": int(SERVER_MIN_INTERVAL / time.Second),
+		"complete":     seeders,
+		"incomplete":   leechers,
+	}
+
+	if q.Get("compact") == "1" {
+		v4 := []peers.Peer{}
+		v6 := []peers.Peer{}
+		for _, p := range list {
+			if p.ip4 != nil {
+				v4 = append(v4, peers.Peer{IP: p.ip4, Port: p.port})
+			}
+			if p.ip6 != nil {
+				v6 = append(v6, peers.Peer{IP: p.ip6, Port: p.port})
+			}
+		}
+		resp["peers"] = string(peers.MarshallPeers(v4))
+		resp["peers6"] = string(peers.MarshallPeers6(v6))
+	} else {
+		noPeerID := q.Get("no_peer_id") == "1"
+		dicts := []interface{}{}
+		for _, p := range list {
+			for _, ip := range []net.IP{p.ip4, p.ip6} {
+				if ip == nil {
+					continue
+				}
+				d := map[string]interface{}{"ip": ip.String(), "port": int(p.port)}
+				if !noPeerID {
+					d["peer id"] = string(p.peerID[:])
+				}
+				dicts = append(dicts, d)
+			}
+		}
+		resp["peers"] = dicts
+	}
+
+	writeBencode(w, resp)
+}
+
+/*
+note: records the announce and picks up to numWant other peers for the
+answer. seeds aren't given other seeds, they have nothing to trade
+*/
+func (s *Server) announce(ih [20]byte, sp *swarmPeer, event Event, numWant int) ([]swarmPeer, int, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sw, ok := s.swarms[ih]
+	if !ok {
+		sw = &swarm{peers: map[[20]byte]*swarmPeer{}}
+		s.swarms[ih] = sw
+	}
+
+	prev, known := sw.peers[sp.peerID]
+	switch {
+	case event == EventStopped:
+		delete(sw.peers, sp.peerID)
+	case event == EventCompleted && (!known || !prev.seed()):
+		sw.completed++
+		sw.peers[sp.peerID] = sp
+	default:
+		sw.peers[sp.peerID] = sp
+	}
+
+	list := []swarmPeer{}
+	if event != EventStopped {
+		// note: map order is random enough to spread peers over the swarm
+		for id, other := range sw.peers {
+			if len(list) >= numWant {
+				break
+			}
+			if id == sp.peerID || (sp.seed() && other.seed()) {
+				continue
+			}
+			list = append(list, *other)
+		}
+	}
+
+	seeders, leechers := sw.counts()
+	return list, seeders, leechers
+}
+
+// note: without an info_hash every tracked swarm is listed
+func (s *Server) handleScrape(w http.ResponseWriter, r *http.Request) {
+	writeBencode(w, map[string]interface{}{"files": s.scrape(r.URL.Query()["info_hash"])})
+}
+
+func (s *Server) scrape(hashes []string) map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	files := map[string]interface{}{}
+	add := func(ih [20]byte, sw *swarm) {
+		seeders, leechers := sw.counts()
+		files[string(ih[:])] = map[string]interface{}{
+			"complete":   seeders,
+			"incomplete": leechers,
+			"downloaded": sw.completed,
+		}
+	}
+
+	if len(hashes) == 0 {
+		for ih, sw := range s.swarms {
+			add(ih, sw)
+		}
+	}
+
+	for _, h := range hashes {
+		if len(h) != 20 {
+			continue
+		}
+
+		var ih [20]byte
+		copy(ih[:], h)
+		if !s.tracked(ih) {
+			continue
+		}
+
+		sw, ok := s.swarms[ih]
+		if !ok {
+			sw = &swarm{}
+		}
+		add(ih, sw)
+	}
+
+	return files
+}
@@ -0,0 +1,165 @@
+package tracker
+
+import (
+	"sync"
+	"time"
+)
+
+/*
+NOTES
+- A session is the life of one torrent as the trackers see it: "started"
+  on the first announce, regular announces every interval after that,
+  "completed" once when the download finishes and "stopped" on the way out
+- Every announce carries the current uploaded/downloaded/left counters,
+  onAnnounce hears how every announce but the last "stopped" one went
+- Until "started" went through it is repeated on every retry, failed
+  announces are retried sooner than the regular interval
+*/
+
+const DEFAULT_INTERVAL = 30 * time.Minute
+const RETRY_INTERVAL = time.Minute
+const STOP_TIMEOUT = 5 * time.Second
+
+type Stats struct {
+	Uploaded   int
+	Downloaded int
+	Left       int
+}
+
+type Session struct {
+	list       *List
+	infoHash   [20]byte
+	peerID     [20]byte
+	port       uint16
+	stats      func() Stats
+	onAnnounce func(*Response, error)
+
+	started   bool
+	failures  int
+	completed chan struct{}
+	stopOnce  sync.Once
+	stop      chan struct{}
+	done      chan struct{}
+}
+
+func NewSession(list *List, infoHash, peerID [20]byte, port uint16, stats func() Stats, onAnnounce func(*Response, error)) *Session {
+	return &Session{
+		list:       list,
+		infoHash:   infoHash,
+		peerID:     peerID,
+		port:       port,
+		stats:      stats,
+		onAnnounce: onAnnounce,
+		completed:  make(chan struct{}, 1),
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+}
+
+/*
+note: sends the "started" announce and keeps the session going in the
+background. the error is the first announce's, the session keeps retrying
+either way
+*/
+func (s *Session) Start() (*Response, error) {
+	resp, err := s.announce(EventStarted)
+	next := s.nextAnnounce(resp, err)
+
+	go s.run(next)
+
+	return resp, err
+}
+
+// note: the download finished, "completed" goes out right away
+func (s *Session) Completed() {
+	select {
+	case s.completed <- struct{}{}:
+	default:
+	}
+}
+
+// note: sends "stopped" and waits for it, but never longer than STOP_TIMEOUT. safe to call more than once
+func (s *Session) Stop() {
+	s.stopOnce.Do(func() { close(s.stop) })
+
+	select {
+	case <-s.done:
+	case <-time.After(STOP_TIMEOUT):
+	}
+}
+
+func (s *Session) run(next time.Duration) {
+	defer close(s.done)
+
+	timer := time.NewTimer(next)
+	defer timer.Stop()
+
+	for {
+		event := EventNone
+		if !s.started {
+			event = EventStarted
+		}
+
+		select {
+		case <-s.stop:
+			if s.started {
+				s.announce(EventStopped)
+			}
+			return
+		case <-s.completed:
+			// note: a tracker that never saw us start doesn't need to hear we completed
+			if s.started {
+				event = EventCompleted
+			}
+			timer.Stop()
+		case <-timer.C:
+		}
+
+		resp, err := s.announce(event)
+		timer.Reset(s.nextAnnounce(resp, err))
+	}
+}
+
+func (s *Session) announce(event Event) (*Response, error) {
+	stats := s.stats()
+
+	resp, err := s.list.Announce(Request{
+		InfoHash:   s.infoHash,
+		PeerID:     s.peerID,
+		Port:       s.port,
+		Uploaded:   stats.Uploaded,
+		Downloaded: stats.Downloaded,
+		Left:       stats.Left,
+		Event:      event,
+		IPv6:       LocalIPv6(),
+	})
+	if event != EventStopped {
+		s.onAnnounce(resp, err)
+	}
+
+	if err != nil {
+		s.failures++
+		return nil, err
+	}
+
+	s.failures = 0
+	if event == EventStarted {
+		s.started = true
+	}
+
+	return resp, nil
+}
+
+// note: failures back off from RETRY_INTERVAL up to the regular interval
+func (s *Session) nextAnnounce(resp *Response, err error) time.Duration {
+	if err != nil {
+		return min(RETRY_INTERVAL<<min(s.failures-1, 5), DEFAULT_INTERVAL)
+	}
+
+	interval := time.Duration(resp.Interval) * time.Second
+	if interval <= 0 {
+		interval = DEFAULT_INTERVAL
+	}
+
+	return max(interval, time.Duration(resp.MinInterval)*time.Second)
+}
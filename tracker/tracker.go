@@ -0,0 +1,119 @@
+package tracker
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"torry/peers"
+)
+
+/*
+NOTES
+- A tracker hands out the addresses of other peers in the swarm
+- The protocol is picked from the scheme of the announce URL: http(s)://
+  trackers speak BEP 3 and udp:// trackers speak BEP 15
+- IPv6 peers (BEP 7) come in "peers6" over HTTP and as 18 byte entries
+  from a UDP tracker that was reached over IPv6. Our own IPv6 address goes
+  out as "ipv6=" so a tracker we reach over IPv4 can hand it out as well
+*/
+
+// note: the values are the event codes of the UDP protocol
+type Event int
+
+const (
+	EventNone Event = iota
+	EventCompleted
+	EventStarted
+	EventStopped
+)
+
+// note: the event parameter of an HTTP announce, empty for a regular one
+func (e Event) String() string {
+	switch e {
+	case EventCompleted:
+		return "completed"
+	case EventStarted:
+		return "started"
+	case EventStopped:
+		return "stopped"
+	default:
+		return ""
+	}
+}
+
+type Request struct {
+	InfoHash   [20]byte
+	PeerID     [20]byte
+	Port       uint16
+	Uploaded   int
+	Downloaded int
+	Left       int
+	Event      Event
+
+	// note: sent as ipv6= over HTTP, nil leaves it out
+	IPv6 net.IP
+}
+
+/*
+note: intervals are in seconds, MinInterval is 0 if the tracker didn't set
+one. Warning is the tracker's "warning message", the announce still went
+through
+*/
+type Response struct {
+	Interval    int
+	MinInterval int
+	Peers       []peers.Peer
+	Warning     string
+}
+
+// note: the tracker answered but turned the request down, Reason is what it said
+type FailureError struct {
+	Tracker string
+	Reason  string
+}
+
+func (e *FailureError) Error() string {
+	return fmt.Sprintf("tracker %s: %s", e.Tracker, e.Reason)
+}
+
+func Announce(announce string, req Request) (*Response, error) {
+	base, err := url.Parse(announce)
+	if err != nil {
+		return nil, err
+	}
+
+	switch base.Scheme {
+	case "http", "https":
+		return announceHTTP(base, req)
+	case "udp":
+		return announceUDP(base, req)
+	default:
+		return nil, fmt.Errorf("unsupported tracker scheme %q", base.Scheme)
+	}
+}
+
+/*
+note: the first global IPv6 address of this machine, nil if it has none.
+unique local (fc00::/7) addresses are skipped, nobody outside could reach
+them
+*/
+func LocalIPv6() net.IP {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil
+	}
+
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+
+		ip := ipNet.IP
+		if ip.To4() == nil && ip.IsGlobalUnicast() && !ip.IsPrivate() {
+			return ip
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,273 @@
+package tracker
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+	"torry/peers"
+)
+
+/*
+NOTES
+- UDP trackers (BEP 15) first hand out a connection ID that has to be sent
+  along with every following request. It is valid for a minute
+- Every request carries a random transaction ID that the tracker echoes
+  back, anything with the wrong transaction ID is ignored
+- A request that gets no answer is resent after 15 * 2^n seconds
+*/
+
+const UDP_PROTOCOL_ID = 0x41727101980
+const UDP_MAX_RETRIES = 3
+const UDP_CONNECTION_TTL = time.Minute
+
+const (
+	actionConnect  uint32 = 0
+	actionAnnounce uint32 = 1
+	actionScrape   uint32 = 2
+	actionError    uint32 = 3
+)
+
+type connectionID struct {
+	id      uint64
+	expires time.Time
+}
+
+// note: connection IDs are cached per tracker address so re-announces can skip the connect step
+var (
+	connectionIDsMu sync.Mutex
+	connectionIDs   = map[string]connectionID{}
+)
+
+type udpTracker struct {
+	conn *net.UDPConn
+	addr string
+}
+
+func newTransactionID() (uint32, error) {
+	buf := make([]byte, 4)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(buf), nil
+}
+
+func retryTimeout(n int) time.Duration {
+	return 15 * time.Second << n
+}
+
+/*
+note: sends the packet and waits for a reply with a matching transaction ID.
+the packet is resent with a growing timeout until the retries run out.
+attempt counts the sends, it carries on from where it is so a request that
+needs a new connection ID doesn't get a fresh set of retries
+*/
+func (ut *udpTracker) roundTrip(packet []byte, transactionID uint32, action uint32, expires time.Time, attempt *int) ([]byte, error) {
+	buf := make([]byte, 2048)
+
+	for ; *attempt <= UDP_MAX_RETRIES; *attempt++ {
+		n := *attempt
+		if !expires.IsZero() && time.Now().After(expires) {
+			return nil, errConnectionExpired
+		}
+
+		_, err := ut.conn.Write(packet)
+		if err != nil {
+			return nil, err
+		}
+
+		ut.conn.SetReadDeadline(time.Now().Add(retryTimeout(n)))
+
+		for {
+			length, err := ut.conn.Read(buf)
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+
+			if length < 8 || binary.BigEndian.Uint32(buf[4:8]) != transactionID {
+				continue
+			}
+
+			gotAction := binary.BigEndian.Uint32(buf[0:4])
+			if gotAction == actionError {
+				return nil, &FailureError{Tracker: ut.addr, Reason: string(buf[8:length])}
+			}
+			if gotAction != action {
+				return nil, fmt.Errorf("expected action %d but got %d", action, gotAction)
+			}
+
+			res := make([]byte, length)
+			copy(res, buf[:length])
+			return res, nil
+		}
+	}
+
+	return nil, fmt.Errorf("tracker %s did not respond", ut.addr)
+}
+
+var errConnectionExpired = errors.New("connection ID expired")
+
+func (ut *udpTracker) connect() (connectionID, error) {
+	connectionIDsMu.Lock()
+	cid, ok := connectionIDs[ut.addr]
+	connectionIDsMu.Unlock()
+
+	if ok && time.Now().Before(cid.expires) {
+		return cid, nil
+	}
+
+	transactionID, err := newTransactionID()
+	if err != nil {
+		return connectionID{}, err
+	}
+
+	// <protocol_id 8 bytes><action 4 bytes><transaction_id 4 bytes>
+	packet := make([]byte, 16)
+	binary.BigEndian.PutUint64(packet[0:8], UDP_PROTOCOL_ID)
+	binary.BigEndian.PutUint32(packet[8:12], actionConnect)
+	binary.BigEndian.PutUint32(packet[12:16], transactionID)
+
+	attempt := 0
+	res, err := ut.roundTrip(packet, transactionID, actionConnect, time.Time{}, &attempt)
+	if err != nil {
+		return connectionID{}, err
+	}
+	if len(res) < 16 {
+		return connectionID{}, fmt.Errorf("connect response is too short: [%d]", len(res))
+	}
+
+	cid = connectionID{
+		id:      binary.BigEndian.Uint64(res[8:16]),
+		expires: time.Now().Add(UDP_CONNECTION_TTL),
+	}
+
+	connectionIDsMu.Lock()
+	connectionIDs[ut.addr] = cid
+	connectionIDsMu.Unlock()
+
+	return cid, nil
+}
+
+func forgetConnectionID(addr string) {
+	connectionIDsMu.Lock()
+	delete(connectionIDs, addr)
+	connectionIDsMu.Unlock()
+}
+
+/*
+note: runs one request that needs a connection ID. if the ID expires while
+the request is still being retried, a new one is fetched and the request
+is sent again. the retries are counted across connection IDs, a tracker
+that connects but never answers is given up on like any other
+*/
+func (ut *udpTracker) request(build func(cid uint64, transactionID uint32) []byte, action uint32) ([]byte, error) {
+	attempt := 0
+	for {
+		cid, err := ut.connect()
+		if err != nil {
+			return nil, err
+		}
+
+		transactionID, err := newTransactionID()
+		if err != nil {
+			return nil, err
+		}
+
+		res, err := ut.roundTrip(build(cid.id, transactionID), transactionID, action, cid.expires, &attempt)
+		if errors.Is(err, errConnectionExpired) {
+			forgetConnectionID(ut.addr)
+			continue
+		}
+		if err != nil {
+			forgetConnectionID(ut.addr)
+		}
+
+		return res, err
+	}
+}
+
+func dialUDP(base *url.URL) (*udpTracker, error) {
+	addr, err := net.ResolveUDPAddr("udp", base.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &udpTracker{conn: conn, addr: base.Host}, nil
+}
+
+func announceUDP(base *url.URL, req Request) (*Response, error) {
+	ut, err := dialUDP(base)
+	if err != nil {
+		return nil, err
+	}
+	defer ut.conn.Close()
+
+	key, err := newTransactionID()
+	if err != nil {
+		return nil, err
+	}
+
+	build := func(cid uint64, transactionID uint32) []byte {
+		/*
+			note: the announce request is 98 bytes
+			<connection_id 8><action 4><transaction_id 4><info_hash 20>
+			<peer_id 20><downloaded 8><left 8><uploaded 8><event 4><ip 4>
+			<key 4><num_want 4><port 2>
+		*/
+		packet := make([]byte, 98)
+		binary.BigEndian.PutUint64(packet[0:8], cid)
+		binary.BigEndian.PutUint32(packet[8:12], actionAnnounce)
+		binary.BigEndian.PutUint32(packet[12:16], transactionID)
+		copy(packet[16:36], req.InfoHash[:])
+		copy(packet[36:56], req.PeerID[:])
+		binary.BigEndian.PutUint64(packet[56:64], uint64(req.Downloaded))
+		binary.BigEndian.PutUint64(packet[64:72], uint64(req.Left))
+		binary.BigEndian.PutUint64(packet[72:80], uint64(req.Uploaded))
+		binary.BigEndian.PutUint32(packet[80:84], uint32(req.Event))
+		binary.BigEndian.PutUint32(packet[84:88], 0)
+		binary.BigEndian.PutUint32(packet[88:92], key)
+		binary.BigEndian.PutUint32(packet[92:96], 0xFFFFFFFF) // note: -1, let the tracker decide
+		binary.BigEndian.PutUint16(packet[96:98], req.Port)
+		return packet
+	}
+
+	res, err := ut.request(build, actionAnnounce)
+	if err != nil {
+		return nil, err
+	}
+
+	// <action 4><transaction_id 4><interval 4><leechers 4><seeders 4><peers 6*n>
+	if len(res) < 20 {
+		return nil, fmt.Errorf("announce response is too short: [%d]", len(res))
+	}
+
+	// note: a tracker we talk to over IPv6 sends 18 byte IPv6 peers instead
+	unmarshall := peers.UnmarshallPeers
+	if addr, ok := ut.conn.RemoteAddr().(*net.UDPAddr); ok && addr.IP.To4() == nil {
+		unmarshall = peers.UnmarshallPeers6
+	}
+
+	peerList, err := unmarshall(res[20:])
+	if err != nil {
+		return nil, err
+	}
+
+	return &Response{
+		Interval: int(binary.BigEndian.Uint32(res[8:12])),
+		Peers:    peerList,
+	}, nil
+}